@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (ac *apiConfig) middlewareAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ac.authenticateAdmin(r); err != nil {
+			slog.WarnContext(r.Context(), "Couldn't authenticate admin request", "err", err)
+			// Makes browsers ask for the key when opening the dashboard.
+			if isSafeMethod(r.Method) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Chirpy admin", charset="UTF-8"`)
+			}
+			handleError(errUnauthorized, w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticateAdmin accepts the admin key as an ApiKey, or as the password
+// of HTTP Basic auth with any user name, which browsers can send. Browsers
+// also resend Basic credentials on requests other sites trigger, so those
+// only count for reads; anything that changes state needs the ApiKey, which
+// a cross-site form can't set.
+func (ac *apiConfig) authenticateAdmin(r *http.Request) error {
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		return authenticateApiKey(ac.adminApiKey, r)
+	}
+	if !isSafeMethod(r.Method) {
+		return errors.New("Basic auth is only accepted for reads")
+	}
+	if ac.adminApiKey == "" {
+		return errors.New("No ApiKey configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(ac.adminApiKey)) != 1 {
+		return errors.New("Wrong ApiKey")
+	}
+	return nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func (ac *apiConfig) getLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	attempts, err := ac.db.GetLoginAttempts(r.Context())
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(attempts, http.StatusOK, w, r)
+}
+
+func (ac *apiConfig) deleteLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	if err := ac.db.ClearLoginAttempts(r.Context(), key); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/config"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+// adminTool is what `chirpy admin` commands work with.
+type adminTool struct {
+	cfg config.Config
+	db  *database.DB
+	in  io.Reader
+	out io.Writer
+	// force is set by the -force flag of the commands that take it.
+	force bool
+}
+
+type adminCommand struct {
+	name string
+	args string
+	help string
+	run  func(ctx context.Context, t adminTool, args []string) error
+	// force is the usage of the command's -force flag, if it has one.
+	force string
+}
+
+var adminCommands = []adminCommand{
+	{"users", "[text]", "list the users, or those whose email contains text", adminListUsers, ""},
+	{"user", "<id|email>", "show a user", adminShowUser, ""},
+	{"set-password", "<id|email>", "set a user's password, read from stdin, lift their login lockout and sign them out", adminSetPassword, ""},
+	{"red", "<id|email> on|off", "grant or revoke Chirpy Red", adminSetChirpyRed, ""},
+	{"delete-chirp", "<id>", "delete a chirp", adminDeleteChirp, ""},
+	{"purge-tokens", "", "forget revoked tokens old enough to have expired", adminPurgeTokens, ""},
+	{"validate", "", "check the database file for inconsistencies, exits with 1 if it finds any", adminValidate, ""},
+	{"stats", "", "print user and chirp statistics", adminStats, ""},
+	{"backup", "[file|-]", "write a backup to file or stdout, or to the backup directory", adminBackup, ""},
+	{"restore", "[-force] <file|->", "replace the database with a backup, after backing it up to the backup directory", adminRestore, "restore a backup with inconsistencies"},
+}
+
+var errAdminUsage = errors.New("usage")
+
+// errInconsistent makes `chirpy admin validate` fail once the problems are
+// printed.
+var errInconsistent = errors.New("the database is inconsistent")
+
+func printAdminUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: chirpy admin <command> [server flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Works on the database directly, found like the server does. Stop the")
+	fmt.Fprintln(w, "server before running commands that write, or its writes may undo them.")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range adminCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.help)
+	}
+	tw.Flush()
+}
+
+// runAdminCommand implements `chirpy admin`.
+func runAdminCommand(args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		printAdminUsage(os.Stdout)
+		if len(args) == 0 {
+			return errAdminUsage
+		}
+		return nil
+	}
+	var cmd *adminCommand
+	for i := range adminCommands {
+		if adminCommands[i].name == args[0] {
+			cmd = &adminCommands[i]
+		}
+	}
+	if cmd == nil {
+		printAdminUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	fs := flag.NewFlagSet("chirpy admin "+cmd.name, flag.ContinueOnError)
+	force := false
+	if cmd.force != "" {
+		fs.BoolVar(&force, "force", false, cmd.force)
+	}
+	cfg, err := config.LoadFlags(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// NewDB would create a missing file, which is never what an operator
+	// pointing at the wrong path wants.
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		return err
+	}
+	db, err := database.NewDB(cfg.DBPath, cfg.Backup.Dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	t := adminTool{cfg: cfg, db: db, in: os.Stdin, out: os.Stdout, force: force}
+	err = cmd.run(context.Background(), t, fs.Args())
+	if errors.Is(err, errAdminUsage) {
+		return fmt.Errorf("usage: chirpy admin %s [server flags] %s", cmd.name, cmd.args)
+	}
+	return err
+}
+
+// findUser looks a user up by id, or by email when arg isn't a number.
+func (t adminTool) findUser(ctx context.Context, arg string) (database.User, error) {
+	var user database.User
+	var err error
+	if id, convErr := strconv.Atoi(arg); convErr == nil {
+		user, err = t.db.FindUserById(ctx, id)
+	} else {
+		user, err = t.db.FindUserByEmail(ctx, arg)
+	}
+	if errors.Is(err, database.ErrNotExist) {
+		return database.User{}, fmt.Errorf("no user %s", arg)
+	}
+	return user, err
+}
+
+func adminListUsers(ctx context.Context, t adminTool, args []string) error {
+	if len(args) > 1 {
+		return errAdminUsage
+	}
+	filter := ""
+	if len(args) == 1 {
+		filter = strings.ToLower(args[0])
+	}
+	users, err := t.db.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(t.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tVERIFIED\tRED\t2FA\tCREATED")
+	for _, user := range users {
+		if filter != "" && !strings.Contains(strings.ToLower(user.Email), filter) {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", user.Id, user.Email, yesNo(user.EmailVerified), yesNo(user.ChirpyRed), yesNo(user.TwoFactorEnabled()), formatMillis(user.CreatedAt))
+	}
+	return tw.Flush()
+}
+
+func adminShowUser(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 1 {
+		return errAdminUsage
+	}
+	user, err := t.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	chirps, err := t.db.GetChirpsByAuthor(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+	attempt, err := t.db.GetLoginAttempt(ctx, accountLoginKey(user.Email))
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(t.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\t%d\n", user.Id)
+	fmt.Fprintf(tw, "Email\t%s\n", user.Email)
+	fmt.Fprintf(tw, "Email verified\t%s\n", yesNo(user.EmailVerified))
+	fmt.Fprintf(tw, "Chirpy Red\t%s\n", yesNo(user.ChirpyRed))
+	fmt.Fprintf(tw, "Two-factor auth\t%s\n", yesNo(user.TwoFactorEnabled()))
+	fmt.Fprintf(tw, "Chirps\t%d\n", len(chirps))
+	fmt.Fprintf(tw, "Created\t%s\n", formatMillis(user.CreatedAt))
+	if attempt.LockedUntil > time.Now().UnixMilli() {
+		fmt.Fprintf(tw, "Locked out until\t%s\n", formatMillis(attempt.LockedUntil))
+	}
+	fmt.Fprintf(tw, "Version\t%d\n", user.Version)
+	return tw.Flush()
+}
+
+func adminSetPassword(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 1 {
+		return errAdminUsage
+	}
+	user, err := t.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	// Passwords are read from stdin rather than taken as an argument, so
+	// they don't end up in the shell history or the process list.
+	if f, ok := t.in.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprintf(os.Stderr, "New password for %s: ", user.Email)
+		}
+	}
+	password, err := bufio.NewReader(t.in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	policy, err := validation.NewPasswordPolicy(t.cfg.PasswordMinLength, t.cfg.BreachedPasswordsPath)
+	if err != nil {
+		return err
+	}
+	v := validation.Validator{}
+	v.Password("password", password, policy)
+	if err := v.Err(); err != nil {
+		return err
+	}
+
+	hashed, err := hashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	user.Password = hashed
+	// Like a password reset, signs the user out everywhere.
+	revokeUserTokens(&user)
+	if _, err := t.db.CompareAndSwapUser(ctx, user, user.Version); err != nil {
+		return err
+	}
+	if err := t.db.ClearLoginAttempts(ctx, accountLoginKey(user.Email)); err != nil && !errors.Is(err, database.ErrNotExist) {
+		return err
+	}
+	fmt.Fprintf(t.out, "Set the password of user %d (%s) and signed them out everywhere.\n", user.Id, user.Email)
+	return nil
+}
+
+func adminSetChirpyRed(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+		return errAdminUsage
+	}
+	user, err := t.findUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := t.db.SetChirpyRed(ctx, user.Id, args[1] == "on"); err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Chirpy Red is %s for user %d (%s).\n", args[1], user.Id, user.Email)
+	return nil
+}
+
+func adminDeleteChirp(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 1 {
+		return errAdminUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errAdminUsage
+	}
+	if err := t.db.DeleteChirp(ctx, id); errors.Is(err, database.ErrNotExist) {
+		return fmt.Errorf("no chirp %d", id)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Deleted chirp %d.\n", id)
+	return nil
+}
+
+func adminPurgeTokens(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 0 {
+		return errAdminUsage
+	}
+	purged, err := t.db.PurgeRevokedTokens(ctx, time.Now().Add(-t.cfg.Tokens.RefreshTTL))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Purged %d revoked tokens.\n", purged)
+	return nil
+}
+
+func adminValidate(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 0 {
+		return errAdminUsage
+	}
+	problems, err := t.db.CheckIntegrity(ctx)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(t.out, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d problems", errInconsistent, len(problems))
+	}
+	fmt.Fprintf(t.out, "%s is consistent.\n", t.cfg.DBPath)
+	return nil
+}
+
+func adminStats(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 0 {
+		return errAdminUsage
+	}
+	stats, err := t.db.Stats(ctx, time.Now(), dashboardDays, dashboardTopAuthors)
+	if err != nil {
+		return err
+	}
+	size, err := t.db.Size()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(t.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Database\t%s, %d bytes\n", t.cfg.DBPath, size)
+	fmt.Fprintf(tw, "Users\t%d\n", stats.Users)
+	fmt.Fprintf(tw, "Verified emails\t%d\n", stats.VerifiedUsers)
+	fmt.Fprintf(tw, "Chirpy Red subscribers\t%d\n", stats.ChirpyRedUsers)
+	fmt.Fprintf(tw, "Chirps\t%d\n", stats.Chirps)
+	fmt.Fprintf(tw, "Revoked tokens\t%d\n", stats.RevokedTokens)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "DAY (UTC)\tSIGNUPS\tCHIRPS")
+	for i, day := range stats.SignupsPerDay {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", day.Day.Format("Mon 2006-01-02"), day.Count, stats.ChirpsPerDay[i].Count)
+	}
+	if len(stats.TopAuthors) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "TOP AUTHORS\tCHIRPS")
+		for _, author := range stats.TopAuthors {
+			fmt.Fprintf(tw, "%d %s\t%d\n", author.UserId, author.Email, author.Chirps)
+		}
+	}
+	return tw.Flush()
+}
+
+func adminBackup(ctx context.Context, t adminTool, args []string) error {
+	if len(args) > 1 {
+		return errAdminUsage
+	}
+	if len(args) == 0 {
+		info, err := t.db.BackupToDir(ctx, t.cfg.Backup.Dir, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(t.out, "Backed up %s to %s, %d bytes.\n", t.cfg.DBPath, filepath.Join(t.cfg.Backup.Dir, info.Name), info.Size)
+		return nil
+	}
+	if args[0] == "-" {
+		_, err := t.db.Backup(ctx, t.out)
+		return err
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := t.db.Backup(ctx, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(args[0])
+		return err
+	}
+	fmt.Fprintf(t.out, "Backed up %s to %s, %d bytes.\n", t.cfg.DBPath, args[0], size)
+	return nil
+}
+
+// adminRestore refuses snapshots that aren't database files, and those with
+// inconsistencies unless forced. The current database is backed up first, so
+// restoring the wrong file can be undone.
+func adminRestore(ctx context.Context, t adminTool, args []string) error {
+	if len(args) != 1 {
+		return errAdminUsage
+	}
+	var snapshot []byte
+	var err error
+	if args[0] == "-" {
+		snapshot, err = io.ReadAll(t.in)
+	} else {
+		snapshot, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := database.ValidateSnapshot(snapshot); err != nil {
+		return err
+	}
+	problems, err := database.CheckSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if !t.force {
+			return fmt.Errorf("%w: %d problems, restore it with -force anyway", errInconsistent, len(problems))
+		}
+	}
+
+	info, err := t.db.BackupToDir(ctx, t.cfg.Backup.Dir, time.Now())
+	if err != nil {
+		return fmt.Errorf("couldn't back up the current database: %w", err)
+	}
+	if err := t.db.Restore(ctx, snapshot); err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Restored %s from %s. The previous contents are in %s.\n", t.cfg.DBPath, args[0], filepath.Join(t.cfg.Backup.Dir, info.Name))
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// formatMillis formats a unix millisecond timestamp, or "-" when it wasn't
+// recorded.
+func formatMillis(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04 UTC")
+}
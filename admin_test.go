@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		auth   func(r *http.Request)
+		want   int
+	}{
+		{"api key read", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "ApiKey admin") }, http.StatusNoContent},
+		{"api key write", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "ApiKey admin") }, http.StatusNoContent},
+		{"basic read", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("", "admin") }, http.StatusNoContent},
+		{"basic write", http.MethodPost, func(r *http.Request) { r.SetBasicAuth("", "admin") }, http.StatusUnauthorized},
+		{"basic delete", http.MethodDelete, func(r *http.Request) { r.SetBasicAuth("", "admin") }, http.StatusUnauthorized},
+		{"wrong basic password", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("", "wrong") }, http.StatusUnauthorized},
+		{"wrong api key", http.MethodPost, func(r *http.Request) { r.Header.Set("Authorization", "ApiKey wrong") }, http.StatusUnauthorized},
+		{"no credentials", http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+	ac := newTestAPI(t)
+	ac.adminApiKey = "admin"
+	handler := ac.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/admin/backups", nil)
+		tt.auth(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestMiddlewareAdminWithoutKey(t *testing.T) {
+	ac := newTestAPI(t)
+	handler := ac.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+	req.SetBasicAuth("", "")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d with no key configured, want 401", w.Code)
+	}
+}
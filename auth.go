@@ -1,27 +1,81 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
 	"github.com/petomackay/chirpy/internal/database"
-	"log"
 )
 
-func (ac *apiConfig) authenticateUserWithToken(tokenString string) (database.User, error) {
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+func (ac *apiConfig) authenticateUserWithToken(ctx context.Context, tokenString string) (database.User, error) {
 	if !isAccessToken(tokenString, []byte(ac.jwtSecret)) {
 		return database.User{}, errors.New("Not a valid access token.")
 	}
 
 	userId, err := getIdFromToken(tokenString, []byte(ac.jwtSecret))
 	if err != nil {
-		log.Println("Couldn't get ID from token during token auth: " + err.Error())
+		slog.InfoContext(ctx, "Couldn't get the user id from an access token", "err", err)
 		return database.User{}, err
 	}
 
-	user, err := ac.db.FindUserById(userId)
+	user, err := ac.db.FindUserById(ctx, userId)
 	if err != nil {
-		log.Printf("Couldn't find used with id %d during token auth: %v\n", userId, err)
+		slog.InfoContext(ctx, "Couldn't find the user of an access token", "user_id", userId, "err", err)
 		return database.User{}, err
 	}
+	if issuedBeforeRevocation(user, tokenString, []byte(ac.jwtSecret)) {
+		slog.InfoContext(ctx, "Rejected an access token issued before the user's tokens were revoked", "user_id", userId)
+		return database.User{}, errors.New("The access token was revoked.")
+	}
+	ac.metrics.sessions.seen(user.Id, time.Now())
 
 	return user, nil
 }
+
+// middlewareAuthRequired rejects requests without a valid access token and
+// stores the authenticated user in the request context.
+func (ac *apiConfig) middlewareAuthRequired(next http.Handler) http.Handler {
+	return ac.middlewareAuth(true, next)
+}
+
+// middlewareAuthOptional lets anonymous requests through, but still rejects
+// requests carrying an invalid access token.
+func (ac *apiConfig) middlewareAuthOptional(next http.Handler) http.Handler {
+	return ac.middlewareAuth(false, next)
+}
+
+func (ac *apiConfig) middlewareAuth(required bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, found := extractTokenString(r)
+		if !found {
+			if required {
+				handleError(errUnauthorized, w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := ac.authenticateUserWithToken(r.Context(), tokenString)
+		if err != nil {
+			handleError(errUnauthorized, w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// userFromContext returns the user stored by the auth middleware.
+func userFromContext(ctx context.Context) (database.User, bool) {
+	user, ok := ctx.Value(userContextKey).(database.User)
+	return user, ok
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+)
+
+// backupJob takes a scheduled backup.
+func (ac *apiConfig) backupJob(ctx context.Context, job jobs.Job) error {
+	_, err := ac.backup(ctx)
+	return err
+}
+
+// backup stores a snapshot of the database in the backup directory and
+// prunes the backups past the retention. A failed prune is only logged, the
+// backup itself succeeded.
+func (ac *apiConfig) backup(ctx context.Context) (database.BackupInfo, error) {
+	info, err := ac.db.BackupToDir(ctx, ac.config.Backup.Dir, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't back up the database", "dir", ac.config.Backup.Dir, "err", err)
+		return database.BackupInfo{}, err
+	}
+	pruned, err := ac.db.PruneBackups(ac.config.Backup.Dir, ac.config.Backup.Keep)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't prune old backups", "dir", ac.config.Backup.Dir, "err", err)
+	}
+	slog.InfoContext(ctx, "Backed up the database", "backup", info.Name, "size", info.Size, "pruned", len(pruned))
+	return info, nil
+}
+
+// postBackupHandler takes a backup right away, e.g. before a risky deploy.
+func (ac *apiConfig) postBackupHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := ac.backup(r.Context())
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(info, http.StatusCreated, w, r)
+}
+
+func (ac *apiConfig) getBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := ac.db.Backups(ac.config.Backup.Dir)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(backups, http.StatusOK, w, r)
+}
+
+// exportHandler downloads a snapshot of the database as it is now, without
+// storing it on the server.
+func (ac *apiConfig) exportHandler(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("chirpy-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Cache-Control", "no-store")
+	n, err := ac.db.Backup(r.Context(), w)
+	if err != nil && n == 0 {
+		w.Header().Del("Content-Disposition")
+		handleErr(err, w, r)
+	} else if err != nil {
+		// The status is out once the snapshot is being written, the
+		// client sees a truncated download.
+		slog.ErrorContext(r.Context(), "Couldn't export the database", "err", err)
+	}
+}
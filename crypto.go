@@ -1,16 +1,29 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-func hashPassword(pwd string) (string, error) {
+func hashPassword(ctx context.Context, pwd string) (string, error) {
+	// bcrypt is slow on purpose, so it gets a span of its own.
+	_, span := tracer.Start(ctx, "bcrypt.GenerateFromPassword")
+	defer span.End()
+
 	hashed, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("Couldn't hash user password: %s", err)
+		slog.ErrorContext(ctx, "Couldn't hash user password", "err", err)
 		return "", err
 	}
 	return string(hashed), nil
 }
+
+// checkPassword fails unless pwd matches the bcrypt hash.
+func checkPassword(ctx context.Context, hash string, pwd string) error {
+	_, span := tracer.Start(ctx, "bcrypt.CompareHashAndPassword")
+	defer span.End()
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd))
+}
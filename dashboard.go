@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/logging"
+)
+
+const (
+	dashboardDays       = 14
+	dashboardTopAuthors = 10
+	// recentErrorsSize is how many error records the dashboard shows.
+	recentErrorsSize = 50
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"percent": func(n int, total int) int {
+		if total == 0 {
+			return 0
+		}
+		return n * 100 / total
+	},
+	"maxCount": func(counts []database.DayCount) int {
+		highest := 0
+		for _, c := range counts {
+			highest = max(highest, c.Count)
+		}
+		return highest
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+
+<head>
+    <meta charset="utf-8">
+    <title>Chirpy Admin</title>
+    <style>
+        body { font-family: sans-serif; margin: 2em; color: #222; }
+        section { margin-bottom: 2em; }
+        table { border-collapse: collapse; }
+        th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+        .tiles { display: flex; gap: 1em; flex-wrap: wrap; }
+        .tile { border: 1px solid #ddd; border-radius: 4px; padding: 0.5em 1em; min-width: 8em; }
+        .tile b { display: block; font-size: 1.6em; }
+        .bar { background: #4a90d9; height: 0.9em; }
+        .muted { color: #888; }
+        .error td { font-family: monospace; font-size: 0.9em; }
+    </style>
+</head>
+
+<body>
+    <h1>Welcome, Chirpy Admin</h1>
+    <p>Chirpy has been visited {{.FileserverHits}} times!</p>
+
+    <section class="tiles">
+        <div class="tile"><b>{{.Stats.Users}}</b>users</div>
+        <div class="tile"><b>{{.Stats.VerifiedUsers}}</b>verified emails</div>
+        <div class="tile"><b>{{.Stats.ChirpyRedUsers}}</b>Chirpy Red subscribers</div>
+        <div class="tile"><b>{{.Stats.Chirps}}</b>chirps</div>
+        <div class="tile"><b>{{.Stats.RevokedTokens}}</b>revoked tokens</div>
+    </section>
+
+    <section>
+        <h2>Last {{len .Stats.SignupsPerDay}} days</h2>
+        <table>
+            <tr><th>Day (UTC)</th><th>Signups</th><th></th><th>Chirps</th><th></th></tr>
+            {{- $maxSignups := maxCount .Stats.SignupsPerDay}}
+            {{- $maxChirps := maxCount .Stats.ChirpsPerDay}}
+            {{- range $i, $day := .Stats.SignupsPerDay}}
+            {{- $chirps := index $.Stats.ChirpsPerDay $i}}
+            <tr>
+                <td>{{$day.Day.Format "Mon 2006-01-02"}}</td>
+                <td>{{$day.Count}}</td>
+                <td style="width: 10em"><div class="bar" style="width: {{percent $day.Count $maxSignups}}%"></div></td>
+                <td>{{$chirps.Count}}</td>
+                <td style="width: 10em"><div class="bar" style="width: {{percent $chirps.Count $maxChirps}}%"></div></td>
+            </tr>
+            {{- end}}
+        </table>
+    </section>
+
+    <section>
+        <h2>Top authors</h2>
+        {{- if .Stats.TopAuthors}}
+        <table>
+            <tr><th>User</th><th>Email</th><th>Chirps</th></tr>
+            {{- range .Stats.TopAuthors}}
+            <tr><td>{{.UserId}}</td><td>{{.Email}}</td><td>{{.Chirps}}</td></tr>
+            {{- end}}
+        </table>
+        {{- else}}
+        <p class="muted">Nobody has chirped yet.</p>
+        {{- end}}
+    </section>
+
+    <section>
+        <h2>Recent errors</h2>
+        {{- if .Errors}}
+        <table class="error">
+            <tr><th>Time (UTC)</th><th>Message</th><th>Details</th></tr>
+            {{- range .Errors}}
+            <tr><td>{{(.Time.UTC).Format "2006-01-02 15:04:05"}}</td><td>{{.Message}}</td><td>{{.Attrs}}</td></tr>
+            {{- end}}
+        </table>
+        {{- else}}
+        <p class="muted">No errors since the server started.</p>
+        {{- end}}
+    </section>
+
+    <p class="muted">Generated at {{(.Now.UTC).Format "2006-01-02 15:04:05"}} UTC.</p>
+</body>
+
+</html>
+`))
+
+type dashboardData struct {
+	Now            time.Time
+	FileserverHits int64
+	Stats          database.Stats
+	Errors         []logging.Entry
+}
+
+// dashboardHandler renders the admin dashboard.
+func (ac *apiConfig) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	stats, err := ac.db.Stats(r.Context(), now, dashboardDays, dashboardTopAuthors)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	data := dashboardData{
+		Now:            now,
+		FileserverHits: ac.fileserverHits.Load(),
+		Stats:          stats,
+		Errors:         ac.recentErrors.Entries(),
+	}
+
+	// Rendering into a buffer first keeps a template error from sending
+	// half a page with a 200.
+	buf := &bytes.Buffer{}
+	if err := dashboardTemplate.Execute(buf, data); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/config"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/seed"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+const (
+	// seedPassword is the password of every seeded user.
+	seedPassword = "chirpy-dev-password"
+	// seedDays spreads seeded signups and chirps over the last two weeks,
+	// which is what the admin dashboard shows.
+	seedDays = 14
+
+	maxSeedUsers  = 1000
+	maxSeedChirps = 10000
+)
+
+var errDevToolsDisabled = apiError{http.StatusForbidden, "dev_tools_disabled", "The dev toolkit is disabled in production."}
+
+type seedBody struct {
+	Seed   int64 `json:"seed"`
+	Users  int   `json:"users"`
+	Chirps int   `json:"chirps"`
+	// Reset wipes the database first, so the same seed gives the same ids.
+	Reset bool `json:"reset"`
+}
+
+type seedResponse struct {
+	Users    int    `json:"users"`
+	Chirps   int    `json:"chirps"`
+	Password string `json:"password"`
+}
+
+func defaultSeedBody() seedBody {
+	return seedBody{Seed: 1, Users: 20, Chirps: 100}
+}
+
+func (b seedBody) validate() error {
+	v := validation.Validator{}
+	if b.Users < 1 || b.Users > maxSeedUsers {
+		v.AddError("users", validation.CodeInvalidFormat)
+	}
+	if b.Chirps < 0 || b.Chirps > maxSeedChirps {
+		v.AddError("chirps", validation.CodeInvalidFormat)
+	}
+	return v.Err()
+}
+
+// middlewareDevOnly refuses requests to the dev toolkit in production.
+func (ac *apiConfig) middlewareDevOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ac.config.Production() {
+			handleError(errDevToolsDisabled, w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resetHandler wipes the database and the visit counter. The database is
+// replaced in a single write under its lock, so concurrent requests see
+// either the old or the empty contents.
+func (ac *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
+	if err := ac.db.Reset(r.Context()); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	ac.fileserverHits.Store(0)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ac *apiConfig) seedHandler(w http.ResponseWriter, r *http.Request) {
+	body := defaultSeedBody()
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	if err := body.validate(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	response, err := seedDatabase(r.Context(), ac.db, ac.config, body)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(response, http.StatusCreated, w, r)
+}
+
+// seedDatabase generates the data described by body and imports it in a
+// single write.
+func seedDatabase(ctx context.Context, db *database.DB, cfg config.Config, body seedBody) (seedResponse, error) {
+	if body.Reset {
+		if err := db.Reset(ctx); err != nil {
+			return seedResponse{}, err
+		}
+	}
+	// Every user gets the same password, hashing it once keeps seeding
+	// fast.
+	hash, err := hashPassword(ctx, seedPassword)
+	if err != nil {
+		return seedResponse{}, err
+	}
+	data := seed.Generate(seed.Options{
+		Seed:           body.Seed,
+		Users:          body.Users,
+		Chirps:         body.Chirps,
+		Days:           seedDays,
+		Now:            time.Now(),
+		PasswordHash:   hash,
+		MaxChirpLength: cfg.ChirpMaxLength,
+	})
+	if err := db.Import(ctx, data); err != nil {
+		return seedResponse{}, err
+	}
+	return seedResponse{Users: len(data.Users), Chirps: len(data.Chirps), Password: seedPassword}, nil
+}
+
+// runSeedCommand implements `chirpy seed`, which seeds the database without
+// starting the server. It takes the server's flags too, to find the
+// database. The server must not be running, its writes could overwrite the
+// seeded data.
+func runSeedCommand(args []string) error {
+	body := defaultSeedBody()
+	fs := flag.NewFlagSet("chirpy seed", flag.ContinueOnError)
+	fs.Int64Var(&body.Seed, "seed", body.Seed, "random seed, the same seed generates the same data")
+	fs.IntVar(&body.Users, "users", body.Users, "number of users to generate")
+	fs.IntVar(&body.Chirps, "chirps", body.Chirps, "number of chirps to generate")
+	fs.BoolVar(&body.Reset, "reset", body.Reset, "wipe the database first")
+
+	cfg, err := config.LoadFlags(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if cfg.Production() {
+		return errors.New("refusing to seed the database in production")
+	}
+	if err := body.validate(); err != nil {
+		return err
+	}
+
+	db, err := database.NewDB(cfg.DBPath, cfg.Backup.Dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	response, err := seedDatabase(context.Background(), db, cfg, body)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Seeded %s with %d users and %d chirps, they all log in with %q.\n", cfg.DBPath, response.Users, response.Chirps, response.Password)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented on this platform, the disk check is skipped.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
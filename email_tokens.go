@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/mailer"
+)
+
+const verifyTokenIssuer = "chirpy-verify"
+const resetTokenIssuer = "chirpy-reset"
+
+// emailTokenClaims binds a token to the address it was sent to, so changing
+// the email invalidates tokens sent to the old one.
+type emailTokenClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func issueEmailToken(user database.User, issuer string, expiration time.Duration, jwtSecret []byte) (string, error) {
+	currentTime := time.Now()
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := emailTokenClaims{
+		Email: user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			IssuedAt:  jwt.NewNumericDate(currentTime),
+			ExpiresAt: jwt.NewNumericDate(currentTime.Add(expiration)),
+			Subject:   strconv.Itoa(user.Id),
+			ID:        hex.EncodeToString(jti),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+var errTokenEmailChanged = errors.New("Token was issued for a different email")
+
+// consumeEmailToken validates a single-use email token and revokes it, so
+// it can't be used again. The user it returns may be stale by the time it's
+// saved, so callers check the email again in modifyUser.
+func (ac *apiConfig) consumeEmailToken(ctx context.Context, tokenString string, issuer string) (database.User, error) {
+	claims := emailTokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(ac.jwtSecret), nil
+	}, jwt.WithIssuer(issuer), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return database.User{}, err
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return database.User{}, err
+	}
+	user, err := ac.db.FindUserById(ctx, userId)
+	if err != nil {
+		return database.User{}, err
+	}
+	if user.Email != claims.Email {
+		return database.User{}, errTokenEmailChanged
+	}
+
+	if err := ac.db.ConsumeToken(ctx, tokenString); err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
+
+const (
+	emailVerification  = "verification"
+	emailPasswordReset = "password_reset"
+)
+
+// emailJobPayload names the email to send. The token in it is only minted
+// when the job runs, so the job queue never holds a usable token.
+type emailJobPayload struct {
+	UserId int    `json:"user_id"`
+	Kind   string `json:"kind"`
+}
+
+func (ac *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) {
+	if _, err := ac.jobs.Enqueue(jobSendEmail, emailJobPayload{UserId: user.Id, Kind: emailVerification}); err != nil {
+		slog.ErrorContext(ctx, "Couldn't queue verification email", "user_id", user.Id, "err", err)
+	}
+}
+
+func (ac *apiConfig) sendPasswordResetEmail(ctx context.Context, user database.User) {
+	if _, err := ac.jobs.Enqueue(jobSendEmail, emailJobPayload{UserId: user.Id, Kind: emailPasswordReset}); err != nil {
+		slog.ErrorContext(ctx, "Couldn't queue password reset email", "user_id", user.Id, "err", err)
+	}
+}
+
+// composeEmail issues the token of an email and writes the message. Every
+// attempt gets a new token, sent to the user's current address.
+func (ac *apiConfig) composeEmail(user database.User, kind string) (mailer.Message, error) {
+	switch kind {
+	case emailVerification:
+		token, err := issueEmailToken(user, verifyTokenIssuer, ac.config.Tokens.VerifyTTL, []byte(ac.jwtSecret))
+		if err != nil {
+			return mailer.Message{}, err
+		}
+		return mailer.Message{
+			To:      user.Email,
+			Subject: "Verify your Chirpy email",
+			Body: fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email address by opening:\n%s/app/verify?token=%s\n\nor by sending this token to POST /api/users/verify:\n%s\n",
+				ac.publicURL, url.QueryEscape(token), token),
+		}, nil
+	case emailPasswordReset:
+		token, err := issueEmailToken(user, resetTokenIssuer, ac.config.Tokens.ResetTTL, []byte(ac.jwtSecret))
+		if err != nil {
+			return mailer.Message{}, err
+		}
+		return mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your Chirpy password",
+			Body: fmt.Sprintf("Someone asked to reset your Chirpy password. If it wasn't you, ignore this email.\n\nReset it by opening:\n%s/app/reset?token=%s\n\nor by sending this token with your new password to POST /api/password-reset/confirm:\n%s\n",
+				ac.publicURL, url.QueryEscape(token), token),
+		}, nil
+	default:
+		return mailer.Message{}, fmt.Errorf("unknown email kind %q", kind)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+func newEmailTokenTest(t *testing.T, issuer string) (*apiConfig, database.User, string) {
+	t.Helper()
+	ac := newTestAPI(t)
+	user, err := ac.db.CreateUser(context.Background(), "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := issueEmailToken(user, issuer, time.Hour, []byte(ac.jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac, user, token
+}
+
+func TestConsumeEmailTokenOnce(t *testing.T) {
+	ac, _, token := newEmailTokenTest(t, verifyTokenIssuer)
+	ctx := context.Background()
+
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := ac.consumeEmailToken(ctx, token, verifyTokenIssuer)
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else if !errors.Is(err, database.ErrAlreadyUsed) {
+			t.Errorf("consumeEmailToken = %v, want nil or %v", err, database.ErrAlreadyUsed)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("the token was redeemed %d times, want once", succeeded)
+	}
+}
+
+func TestVerifyEmailHandlerRedeemsOnce(t *testing.T) {
+	ac, user, token := newEmailTokenTest(t, verifyTokenIssuer)
+	verify := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/users/verify", strings.NewReader(`{"token":"`+token+`"}`))
+		w := httptest.NewRecorder()
+		ac.verifyEmailHandler(w, req)
+		return w.Code
+	}
+
+	if status := verify(); status != http.StatusOK {
+		t.Fatalf("first redemption: status %d, want 200", status)
+	}
+	if status := verify(); status != http.StatusBadRequest {
+		t.Errorf("second redemption: status %d, want 400", status)
+	}
+	stored, err := ac.db.FindUserById(context.Background(), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.EmailVerified {
+		t.Error("the email isn't verified")
+	}
+}
+
+func TestPasswordResetRevokesEarlierTokens(t *testing.T) {
+	ac, user, token := newEmailTokenTest(t, resetTokenIssuer)
+	ctx := context.Background()
+	// Minted within the same second as the reset, and likely the same
+	// millisecond.
+	before, err := issueAccessToken(user, time.Hour, []byte(ac.jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/password-reset/confirm", strings.NewReader(`{"token":"`+token+`","password":"correct-horse-battery"}`))
+	w := httptest.NewRecorder()
+	ac.passwordResetConfirmHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("reset: status %d, want 204", w.Code)
+	}
+	if _, err := ac.authenticateUserWithToken(ctx, before); err == nil {
+		t.Error("a token minted just before the reset is still accepted")
+	}
+
+	user, err = ac.db.FindUserById(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := issueAccessToken(user, time.Hour, []byte(ac.jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.authenticateUserWithToken(ctx, after); err != nil {
+		t.Errorf("a token minted after the reset is rejected: %v", err)
+	}
+}
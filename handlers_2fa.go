@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+type twoFactorEnrolResponse struct {
+	URI           string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type twoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type twoFactorConfirmBody struct {
+	Code string `json:"code"`
+}
+
+type twoFactorLoginBody struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+func (ac *apiConfig) postTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	if user.TwoFactorEnabled() {
+		handleError(errTwoFactorEnabled, w, r)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	// Two-factor auth stays off until the secret is confirmed, so a user who
+	// never scans it isn't locked out. The recovery codes aren't accepted
+	// before then either.
+	user.TOTPPendingSecret = secret
+	user.RecoveryCodes = hashes
+	if _, err := ac.db.CompareAndSwapUser(r.Context(), user, user.Version); err != nil {
+		handleUserSwapErr(err, w, r)
+		return
+	}
+
+	sendResponse(twoFactorEnrolResponse{URI: totpURI(secret, user.Email), RecoveryCodes: codes}, http.StatusCreated, w, r)
+}
+
+// postTwoFactorConfirmHandler turns two-factor auth on once the user proves
+// their authenticator has the pending secret.
+func (ac *apiConfig) postTwoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	body := twoFactorConfirmBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	if user.TwoFactorEnabled() {
+		handleError(errTwoFactorEnabled, w, r)
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		handleError(errTwoFactorNotPending, w, r)
+		return
+	}
+
+	step, ok := validateTOTP(user.TOTPPendingSecret, body.Code, 0, time.Now())
+	if !ok {
+		handleError(errInvalidTwoFactorCode, w, r)
+		return
+	}
+
+	user.TOTPSecret = user.TOTPPendingSecret
+	user.TOTPPendingSecret = ""
+	// The confirmation code can't be used to log in again.
+	user.TOTPLastStep = step
+	if _, err := ac.db.CompareAndSwapUser(r.Context(), user, user.Version); err != nil {
+		handleUserSwapErr(err, w, r)
+		return
+	}
+	slog.InfoContext(r.Context(), "User enabled two-factor auth", "user_id", user.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ac *apiConfig) twoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	body := twoFactorLoginBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	if !isChallengeToken(body.ChallengeToken, []byte(ac.jwtSecret)) {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	userId, err := getIdFromToken(body.ChallengeToken, []byte(ac.jwtSecret))
+	if err != nil {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	user, err := ac.db.FindUserById(r.Context(), userId)
+	if err != nil || !user.TwoFactorEnabled() || issuedBeforeRevocation(user, body.ChallengeToken, []byte(ac.jwtSecret)) {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+
+	now := time.Now()
+	ipKey := ipLoginKey(r)
+	accountKey := accountLoginKey(user.Email)
+	if retryAfter := max(ac.loginRetryAfter(r.Context(), ipKey, now), ac.loginRetryAfter(r.Context(), accountKey, now)); retryAfter > 0 {
+		sendTooManyRequests(retryAfter, errTooManyLogins, w, r)
+		return
+	}
+
+	// The code is checked against the copy read above, but only the database
+	// decides whether it's still unused, so two requests racing with the same
+	// code can't both log in.
+	verified := false
+	switch {
+	case body.Code != "":
+		if step, ok := validateTOTP(user.TOTPSecret, body.Code, user.TOTPLastStep, now); ok {
+			err = ac.db.UseTOTPStep(r.Context(), user.Id, step)
+			verified = err == nil
+		}
+	case body.RecoveryCode != "":
+		err = ac.db.UseRecoveryCode(r.Context(), user.Id, hashRecoveryCode(body.RecoveryCode))
+		verified = err == nil
+		if verified {
+			slog.InfoContext(r.Context(), "User logged in with a recovery code", "user_id", user.Id)
+		}
+	}
+	if err != nil && !errors.Is(err, database.ErrAlreadyUsed) {
+		handleErr(err, w, r)
+		return
+	}
+	if !verified {
+		ac.recordLoginFailure(r.Context(), ipKey, maxIPLoginFailures, now)
+		ac.recordLoginFailure(r.Context(), accountKey, maxAccountLoginFailures, now)
+		handleError(errInvalidTwoFactorCode, w, r)
+		return
+	}
+
+	ac.clearLoginFailures(r.Context(), accountKey)
+	ac.sendLoginTokens(user, w, r)
+}
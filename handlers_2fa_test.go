@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC lists 8 digit codes; ours are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfcSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", "050471", 0, step, true},
+		{"previous step", "081804", 0, step - 1, true},
+		{"wrong code", "123456", 0, 0, false},
+		{"replayed", "050471", step, 0, false},
+		{"older than the last step", "081804", step, 0, false},
+	}
+	for _, tt := range tests {
+		gotStep, gotOK := validateTOTP(rfcSecret, tt.code, tt.lastStep, now)
+		if gotStep != tt.wantStep || gotOK != tt.wantOK {
+			t.Errorf("%s: validateTOTP = %d, %v, want %d, %v", tt.name, gotStep, gotOK, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+// newTwoFactorUser creates a user with two-factor auth on, using the RFC
+// secret, and returns it with a recovery code.
+func newTwoFactorUser(t *testing.T, ac *apiConfig) (database.User, string) {
+	t.Helper()
+	ctx := context.Background()
+	user, err := ac.db.CreateUser(ctx, "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.TOTPSecret = rfcSecret
+	user.RecoveryCodes = hashes
+	if user, err = ac.db.CompareAndSwapUser(ctx, user, user.Version); err != nil {
+		t.Fatal(err)
+	}
+	return user, codes[0]
+}
+
+func twoFactorLogin(t *testing.T, ac *apiConfig, user database.User, field string, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	challenge, err := issueChallengeToken(user, time.Minute, []byte(ac.jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"challenge_token":"` + challenge + `","` + field + `":"` + code + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/login/2fa", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ac.twoFactorLoginHandler(w, req)
+	return w
+}
+
+func TestTwoFactorLoginRejectsReusedCodes(t *testing.T) {
+	t.Run("totp", func(t *testing.T) {
+		ac := newTestAPI(t)
+		user, _ := newTwoFactorUser(t, ac)
+		code, err := totpCode(rfcSecret, time.Now().Unix()/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := twoFactorLogin(t, ac, user, "code", code); w.Code != http.StatusOK {
+			t.Fatalf("first login: status %d, want 200", w.Code)
+		}
+		if w := twoFactorLogin(t, ac, user, "code", code); w.Code != http.StatusUnauthorized {
+			t.Errorf("reused code: status %d, want 401", w.Code)
+		}
+	})
+	t.Run("recovery code", func(t *testing.T) {
+		ac := newTestAPI(t)
+		user, recoveryCode := newTwoFactorUser(t, ac)
+		if w := twoFactorLogin(t, ac, user, "recovery_code", recoveryCode); w.Code != http.StatusOK {
+			t.Fatalf("first login: status %d, want 200", w.Code)
+		}
+		if w := twoFactorLogin(t, ac, user, "recovery_code", recoveryCode); w.Code != http.StatusUnauthorized {
+			t.Errorf("reused recovery code: status %d, want 401", w.Code)
+		}
+		stored, err := ac.db.FindUserById(context.Background(), user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.RecoveryCodes) != recoveryCodeCount-1 {
+			t.Errorf("%d recovery codes left, want %d", len(stored.RecoveryCodes), recoveryCodeCount-1)
+		}
+	})
+}
+
+func TestUseTOTPStepOnce(t *testing.T) {
+	ac := newTestAPI(t)
+	user, _ := newTwoFactorUser(t, ac)
+	ctx := context.Background()
+	// Every request has read the same user, with no step recorded yet.
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() { results <- ac.db.UseTOTPStep(ctx, user.Id, 100) }()
+	}
+	succeeded := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else if !errors.Is(err, database.ErrAlreadyUsed) {
+			t.Errorf("UseTOTPStep = %v, want nil or %v", err, database.ErrAlreadyUsed)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("the step was used %d times, want once", succeeded)
+	}
+}
+
+func TestTwoFactorEnrolmentNeedsConfirmation(t *testing.T) {
+	ac := newTestAPI(t)
+	ctx := context.Background()
+	user, err := ac.db.CreateUser(ctx, "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handlers get the user the auth middleware read.
+	authenticated := func(method string, target string, body string) *http.Request {
+		user, err := ac.db.FindUserById(ctx, user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		return req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+	}
+	confirm := func(code string) int {
+		w := httptest.NewRecorder()
+		ac.postTwoFactorConfirmHandler(w, authenticated(http.MethodPost, "/api/users/2fa/confirm", `{"code":"`+code+`"}`))
+		return w.Code
+	}
+
+	if status := confirm("123456"); status != http.StatusConflict {
+		t.Errorf("confirming before enrolling: status %d, want 409", status)
+	}
+
+	w := httptest.NewRecorder()
+	ac.postTwoFactorHandler(w, authenticated(http.MethodPost, "/api/users/2fa", ""))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("enrolling: status %d, want 201", w.Code)
+	}
+	pending, err := ac.db.FindUserById(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.TwoFactorEnabled() || pending.TOTPPendingSecret == "" {
+		t.Fatalf("user = %+v, want a pending secret and two-factor auth off", pending)
+	}
+
+	if status := confirm("000000"); status != http.StatusUnauthorized {
+		t.Errorf("confirming with a wrong code: status %d, want 401", status)
+	}
+	code, err := totpCode(pending.TOTPPendingSecret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := confirm(code); status != http.StatusNoContent {
+		t.Fatalf("confirming: status %d, want 204", status)
+	}
+	enabled, err := ac.db.FindUserById(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled.TOTPSecret != pending.TOTPPendingSecret || enabled.TOTPPendingSecret != "" {
+		t.Errorf("user = %+v, want the pending secret enabled", enabled)
+	}
+	// The confirmation code doesn't log in.
+	if w := twoFactorLogin(t, ac, enabled, "code", code); w.Code != http.StatusUnauthorized {
+		t.Errorf("logging in with the confirmation code: status %d, want 401", w.Code)
+	}
+}
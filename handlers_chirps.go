@@ -1,8 +1,7 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"regexp"
 	"slices"
@@ -11,48 +10,54 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
 )
 
 type chirpParams struct {
 	Body string `json:"body"`
 }
 
+type postChirpParams struct {
+	Body    string `json:"body"`
+	ReplyTo int    `json:"reply_to"`
+}
+
+var profanityRe = regexp.MustCompile(`(?i)kerfuffle|sharbert|fornax`)
+
 func (ac *apiConfig) postChirpHandler(w http.ResponseWriter, r *http.Request) {
-	tokenString, found := extractTokenString(r)
-	if !found {
-		handleError("Unauthorized", http.StatusUnauthorized, w)
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
 		return
 	}
 
-	user, err := ac.authenticateUserWithToken(tokenString)
-	if err != nil {
-		handleError("Unauthorized", http.StatusUnauthorized, w)
-	}
-
 	userId := user.Id
 
-	decoder := json.NewDecoder(r.Body)
-	chirp := chirpParams{}
-	err = decoder.Decode(&chirp)
-	if err != nil {
-		handleError("Couldn't decode json", http.StatusInternalServerError, w)
+	chirp := postChirpParams{}
+	if err := decodeJSONBody(w, r, &chirp); err != nil {
+		handleErr(err, w, r)
 		return
 	}
 
-	if len(chirp.Body) > 140 {
-		handleError("Chirp is too long", 400, w)
+	if len(chirp.Body) > ac.config.ChirpMaxLength {
+		handleError(errChirpTooLong, w, r)
 		return
 	}
 
-	re := regexp.MustCompile(`(?i)kerfuffle|sharbert|fornax`)
-	sanitized := re.ReplaceAllString(chirp.Body, "****")
+	sanitized := profanityRe.ReplaceAllString(chirp.Body, "****")
 
-	responseData, err := ac.db.CreateChirp(sanitized, userId)
+	responseData, err := ac.db.CreateChirp(r.Context(), sanitized, userId, chirp.ReplyTo)
+	if errors.Is(err, database.ErrNotExist) {
+		handleErr(validation.NewErrors("reply_to", validation.CodeInvalidFormat), w, r)
+		return
+	}
 	if err != nil {
-		handleError("Couldn't create a new chirp"+err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
-	sendJson(responseData, http.StatusCreated, w)
+	ac.metrics.chirpsCreated.Inc()
+	ac.notifyChirp(r.Context(), responseData)
+	sendResponse(responseData, http.StatusCreated, w, r)
 }
 
 func (ac *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,21 +65,21 @@ func (ac *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	var chirps []database.Chirp
 	var err error
 	if authorId == "" {
-		chirps, err = ac.db.GetChirps()
+		chirps, err = ac.db.GetChirps(r.Context())
 		if err != nil {
-			handleError(fmt.Sprintf("Couldn't retrieve chirps: %v", err), http.StatusInternalServerError, w)
+			handleErr(err, w, r)
 			return
 		}
 	} else {
 		authorIdInt, err := strconv.Atoi(authorId)
 
 		if err != nil {
-			handleError("BAD REQUEST", http.StatusBadRequest, w)
+			handleErr(validation.NewErrors("author_id", validation.CodeInvalidFormat), w, r)
 			return
 		}
-		chirps, err = ac.db.GetChirpsByAuthor(authorIdInt)
+		chirps, err = ac.db.GetChirpsByAuthor(r.Context(), authorIdInt)
 		if err != nil {
-			handleError(fmt.Sprintf("Couldn't retrieve chirps: %v", err), http.StatusInternalServerError, w)
+			handleErr(err, w, r)
 			return
 		}
 	}
@@ -90,53 +95,139 @@ func (ac *apiConfig) getChirpsHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	sendJson(chirps, http.StatusOK, w)
+	sendResponse(chirps, http.StatusOK, w, r)
 }
 
 func (ac *apiConfig) getChirpByIDHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		handleError("Invalid ID format: "+err.Error(), http.StatusBadRequest, w)
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
 		return
 	}
 
-	chirp, err := ac.db.GetChirp(id)
+	chirp, err := ac.db.GetChirp(r.Context(), id)
 	if err != nil {
-		handleError(fmt.Sprintf("Couldn't retrieve chirp: %s", err), http.StatusNotFound, w)
+		handleErr(err, w, r)
 		return
 	}
-	sendJson(chirp, http.StatusOK, w)
+	w.Header().Set("ETag", versionETag(chirp.Version))
+	sendResponse(chirp, http.StatusOK, w, r)
 
 }
 
 func (ac *apiConfig) deleteChirpHandler(w http.ResponseWriter, r *http.Request) {
-	tokenString, found := extractTokenString(r)
-	if !found {
-		handleError("Unathorized", http.StatusUnauthorized, w)
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
 		return
 	}
-	user, err := ac.authenticateUserWithToken(tokenString)
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		handleError("Unathorized", http.StatusUnauthorized, w)
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	chirp, err := ac.db.GetChirp(r.Context(), id)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	if chirp.UserId != user.Id {
+		handleError(errForbidden, w, r)
+		return
+	}
+	if !checkIfMatch(r, chirp.Version) {
+		handleError(errPreconditionFailed, w, r)
+		return
+	}
+	if err := ac.db.CompareAndDeleteChirp(r.Context(), id, chirp.Version); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (ac *apiConfig) putChirpHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
 		return
 	}
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		handleError("Invalid ID format: "+err.Error(), http.StatusBadRequest, w)
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+
+	params := chirpParams{}
+	if err := decodeJSONBody(w, r, &params); err != nil {
+		handleErr(err, w, r)
+		return
 	}
-	chirp, err := ac.db.GetChirp(id)
+	if len(params.Body) > ac.config.ChirpMaxLength {
+		handleError(errChirpTooLong, w, r)
+		return
+	}
+
+	chirp, err := ac.db.GetChirp(r.Context(), id)
 	if err != nil {
-		handleError("Chirp not found", http.StatusNotFound, w)
+		handleErr(err, w, r)
 		return
 	}
 	if chirp.UserId != user.Id {
-		handleError("Forbidden", http.StatusForbidden, w)
+		handleError(errForbidden, w, r)
 		return
 	}
-	if err := ac.db.DeleteChirp(id); err != nil {
-		handleError("Couldn't delete chirp", http.StatusInternalServerError, w)
+	if !checkIfMatch(r, chirp.Version) {
+		handleError(errPreconditionFailed, w, r)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	return
+
+	chirp.Body = profanityRe.ReplaceAllString(params.Body, "****")
+	chirp, err = ac.db.CompareAndSwapChirp(r.Context(), chirp, chirp.Version)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.Header().Set("ETag", versionETag(chirp.Version))
+	sendResponse(chirp, http.StatusOK, w, r)
+}
+
+func (ac *apiConfig) postChirpLikeHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	if err := ac.db.LikeChirp(r.Context(), id, user.Id); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	if chirp, err := ac.db.GetChirp(r.Context(), id); err == nil {
+		ac.notify(r.Context(), chirp.UserId, database.NotificationLike, user.Id, chirp.Id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ac *apiConfig) deleteChirpLikeHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	if err := ac.db.UnlikeChirp(r.Context(), id, user.Id); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+type tokenBody struct {
+	Token string `json:"token"`
+}
+
+type passwordResetBody struct {
+	Email string `json:"email"`
+}
+
+type passwordResetConfirmBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (ac *apiConfig) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	body := tokenBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	user, err := ac.consumeEmailToken(r.Context(), body.Token, verifyTokenIssuer)
+	if err != nil {
+		slog.InfoContext(r.Context(), "Couldn't verify email", "err", err)
+		handleError(errInvalidToken, w, r)
+		return
+	}
+
+	user, err = ac.modifyUser(r.Context(), user.Id, func(stored *database.User) error {
+		if stored.Email != user.Email {
+			return errTokenEmailChanged
+		}
+		stored.EmailVerified = true
+		return nil
+	})
+	if errors.Is(err, errTokenEmailChanged) {
+		handleError(errInvalidToken, w, r)
+		return
+	}
+	if err != nil {
+		handleUserSwapErr(err, w, r)
+		return
+	}
+	sendResponse(newUserResponse(user), http.StatusOK, w, r)
+}
+
+// passwordResetHandler always answers 202, so it can't be used to find out
+// which emails have an account.
+func (ac *apiConfig) passwordResetHandler(w http.ResponseWriter, r *http.Request) {
+	body := passwordResetBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	if user, err := ac.db.FindUserByEmail(r.Context(), body.Email); err == nil {
+		ac.sendPasswordResetEmail(r.Context(), user)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (ac *apiConfig) passwordResetConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	body := passwordResetConfirmBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	v := validation.Validator{}
+	v.Required("token", body.Token)
+	v.Password("password", body.Password, ac.passwordPolicy)
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	user, err := ac.consumeEmailToken(r.Context(), body.Token, resetTokenIssuer)
+	if err != nil {
+		slog.InfoContext(r.Context(), "Couldn't reset password", "err", err)
+		handleError(errInvalidToken, w, r)
+		return
+	}
+
+	hashedPwd, err := hashPassword(r.Context(), body.Password)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	user, err = ac.modifyUser(r.Context(), user.Id, func(stored *database.User) error {
+		if stored.Email != user.Email {
+			return errTokenEmailChanged
+		}
+		stored.Password = hashedPwd
+		// Receiving the reset email proves ownership of the address.
+		stored.EmailVerified = true
+		// Whoever the reset locks out mustn't keep their sessions.
+		revokeUserTokens(stored)
+		return nil
+	})
+	if errors.Is(err, errTokenEmailChanged) {
+		handleError(errInvalidToken, w, r)
+		return
+	}
+	if err != nil {
+		handleUserSwapErr(err, w, r)
+		return
+	}
+	ac.clearLoginFailures(r.Context(), accountLoginKey(user.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/go-chi/chi/v5"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
 )
 
 type userBody struct {
@@ -14,10 +18,21 @@ type userBody struct {
 }
 
 type userResponse struct {
-	Id        int    `json:"id"`
-	Email     string `json:"email"`
-	ChirpyRed bool   `json:"is_chirpy_red"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	ChirpyRed     bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
 }
+
+func newUserResponse(user database.User) userResponse {
+	return userResponse{
+		Id:            user.Id,
+		Email:         user.Email,
+		ChirpyRed:     user.ChirpyRed,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
 type userLoginResponse struct {
 	userResponse
 	Token        string `json:"token"`
@@ -25,92 +40,255 @@ type userLoginResponse struct {
 }
 
 func (ac *apiConfig) postUsersHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
 	user := userBody{}
-	if err := decoder.Decode(&user); err != nil {
-		handleError("Couldn't decode user json: "+err.Error(), http.StatusBadRequest, w)
+	if err := decodeJSONBody(w, r, &user); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	v := validation.Validator{}
+	v.Email("email", user.Email)
+	v.Password("password", user.Password, ac.passwordPolicy)
+	if v.Valid() && ac.emailTaken(r.Context(), user.Email, 0) {
+		v.AddError("email", validation.CodeAlreadyTaken)
+	}
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
 		return
 	}
 
-	hashedPwd, err := hashPassword(user.Password)
+	hashedPwd, err := hashPassword(r.Context(), user.Password)
 	if err != nil {
-		handleError("Couldn't create a new user: "+err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
 
-	responseData, err := ac.db.CreateUser(user.Email, hashedPwd)
+	responseData, err := ac.db.CreateUser(r.Context(), user.Email, hashedPwd)
 	if err != nil {
-		handleError("Couldn't create a new user: "+err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
-	sendJson(userResponse{Id: responseData.Id, Email: responseData.Email, ChirpyRed: responseData.ChirpyRed}, http.StatusCreated, w)
+	ac.sendVerificationEmail(r.Context(), responseData)
+	sendResponse(newUserResponse(responseData), http.StatusCreated, w, r)
 }
 
 func (ac *apiConfig) userLoginHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
 	userBody := userBody{}
-	if err := decoder.Decode(&userBody); err != nil {
-		handleError("Couldn't decode user json: "+err.Error(), http.StatusBadRequest, w)
+	if err := decodeJSONBody(w, r, &userBody); err != nil {
+		handleErr(err, w, r)
 		return
 	}
 
-	user, err := ac.db.FindUserByEmail(userBody.Email)
+	now := time.Now()
+	ipKey := ipLoginKey(r)
+	accountKey := accountLoginKey(userBody.Email)
+	if retryAfter := max(ac.loginRetryAfter(r.Context(), ipKey, now), ac.loginRetryAfter(r.Context(), accountKey, now)); retryAfter > 0 {
+		sendTooManyRequests(retryAfter, errTooManyLogins, w, r)
+		return
+	}
+
+	user, err := ac.db.FindUserByEmail(r.Context(), userBody.Email)
 	if err != nil {
-		handleError(err.Error(), http.StatusBadRequest, w)
+		// Only existing accounts are tracked, otherwise made up emails
+		// would grow the database without bound.
+		ac.recordLoginFailure(r.Context(), ipKey, maxIPLoginFailures, now)
+		handleError(errInvalidCredentials, w, r)
+		return
+	}
+	if err := checkPassword(r.Context(), user.Password, userBody.Password); err != nil {
+		ac.recordLoginFailure(r.Context(), ipKey, maxIPLoginFailures, now)
+		ac.recordLoginFailure(r.Context(), accountKey, maxAccountLoginFailures, now)
+		handleError(errInvalidCredentials, w, r)
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(userBody.Password)); err != nil {
-		handleError(err.Error(), http.StatusUnauthorized, w)
+	ac.clearLoginFailures(r.Context(), accountKey)
+
+	if user.TwoFactorEnabled() {
+		challengeToken, err := issueChallengeToken(user, ac.config.Tokens.ChallengeTTL, []byte(ac.jwtSecret))
+		if err != nil {
+			handleErr(err, w, r)
+			return
+		}
+		sendResponse(twoFactorChallengeResponse{TwoFactorRequired: true, ChallengeToken: challengeToken}, http.StatusOK, w, r)
 		return
 	}
 
-	userId := strconv.Itoa(user.Id)
-	accessToken, err := issueAccessToken(userId, []byte(ac.jwtSecret))
+	ac.sendLoginTokens(user, w, r)
+}
+
+func (ac *apiConfig) sendLoginTokens(user database.User, w http.ResponseWriter, r *http.Request) {
+	accessToken, err := issueAccessToken(user, ac.config.Tokens.AccessTTL, []byte(ac.jwtSecret))
 	if err != nil {
-		handleError(err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
-	refreshToken, err := issueRefreshToken(userId, []byte(ac.jwtSecret))
+	refreshToken, err := issueRefreshToken(user, ac.config.Tokens.RefreshTTL, []byte(ac.jwtSecret))
 	if err != nil {
-		handleError(err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
 
-	sendJson(userLoginResponse{userResponse: userResponse{Id: user.Id, Email: user.Email, ChirpyRed: user.ChirpyRed}, Token: accessToken, RefreshToken: refreshToken}, http.StatusOK, w)
+	sendResponse(userLoginResponse{userResponse: newUserResponse(user), Token: accessToken, RefreshToken: refreshToken}, http.StatusOK, w, r)
 }
 
+type userPatchBody struct {
+	Password *string `json:"password"`
+	Email    *string `json:"email"`
+}
+
+// putUsersHandler replaces the email and password, so both are required.
 func (ac *apiConfig) putUsersHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	userBody := userBody{}
-	if err := decoder.Decode(&userBody); err != nil {
-		handleError("Couldn't decode use json: "+err.Error(), http.StatusBadRequest, w)
+	if !requireIfMatch(w, r) {
 		return
 	}
-	tokenString, found := extractTokenString(r)
-	if !found {
-		handleError("Unknown auth type", http.StatusBadRequest, w)
+	body := userBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
 		return
 	}
+	ac.updateUser(userPatchBody{Email: &body.Email, Password: &body.Password}, w, r)
+}
 
-	user, err := ac.authenticateUserWithToken(tokenString)
-	if err != nil {
-		handleError("Couldn't find user", http.StatusUnauthorized, w)
+// patchUsersHandler only changes the fields present in the body.
+func (ac *apiConfig) patchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	body := userPatchBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
 		return
 	}
+	ac.updateUser(body, w, r)
+}
 
-	hashedPwd, err := hashPassword(userBody.Password)
+func (ac *apiConfig) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	w.Header().Set("ETag", versionETag(user.Version))
+	sendResponse(newUserResponse(user), http.StatusOK, w, r)
+}
+
+// userSwapAttempts bounds how often modifyUser retries after losing a race.
+const userSwapAttempts = 3
+
+// modifyUser applies fn to the stored user and saves the result with
+// CompareAndSwapUser. When another write got there first, it starts again
+// from a fresh copy, so fn must only depend on the user it's given. An
+// error from fn aborts without saving.
+func (ac *apiConfig) modifyUser(ctx context.Context, userId int, fn func(user *database.User) error) (database.User, error) {
+	for attempt := 1; ; attempt++ {
+		user, err := ac.db.FindUserById(ctx, userId)
+		if err != nil {
+			return database.User{}, err
+		}
+		if err := fn(&user); err != nil {
+			return database.User{}, err
+		}
+		user, err = ac.db.CompareAndSwapUser(ctx, user, user.Version)
+		if !errors.Is(err, database.ErrVersionMismatch) || attempt == userSwapAttempts {
+			return user, err
+		}
+	}
+}
+
+func (ac *apiConfig) updateUser(body userPatchBody, w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	version := user.Version
+	if !checkIfMatch(r, version) {
+		handleError(errPreconditionFailed, w, r)
+		return
+	}
+
+	v := validation.Validator{}
+	if body.Email != nil {
+		v.Email("email", *body.Email)
+		if v.Valid() && ac.emailTaken(r.Context(), *body.Email, user.Id) {
+			v.AddError("email", validation.CodeAlreadyTaken)
+		}
+	}
+	if body.Password != nil {
+		v.Password("password", *body.Password, ac.passwordPolicy)
+	}
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	emailChanged := body.Email != nil && user.Email != *body.Email
+	if emailChanged {
+		user.Email = *body.Email
+		user.EmailVerified = false
+	}
+	if body.Password != nil {
+		hashedPwd, err := hashPassword(r.Context(), *body.Password)
+		if err != nil {
+			handleErr(err, w, r)
+			return
+		}
+		user.Password = hashedPwd
+	}
+
+	user, err := ac.db.CompareAndSwapUser(r.Context(), user, version)
+	if err != nil && r.Header.Get("If-Match") == "" {
+		handleUserSwapErr(err, w, r)
+		return
+	}
 	if err != nil {
-		handleError("Couldn't create a new user: "+err.Error(), http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
+	if emailChanged {
+		ac.sendVerificationEmail(r.Context(), user)
+	}
 
-	user.Email = userBody.Email
-	user.Password = hashedPwd
+	w.Header().Set("ETag", versionETag(user.Version))
+	sendResponse(newUserResponse(user), http.StatusOK, w, r)
+}
+
+// emailTaken reports whether a user other than exceptId already uses email.
+func (ac *apiConfig) emailTaken(ctx context.Context, email string, exceptId int) bool {
+	user, err := ac.db.FindUserByEmail(ctx, email)
+	return err == nil && user.Id != exceptId
+}
 
-	if err := ac.db.UpdateUser(user); err != nil {
-		handleError("Error when updating user: "+err.Error(), http.StatusInternalServerError, w)
+func (ac *apiConfig) postFollowHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id == user.Id {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	if err := ac.db.Follow(r.Context(), user.Id, id); err != nil {
+		handleErr(err, w, r)
 		return
 	}
+	ac.notify(r.Context(), id, database.NotificationFollow, user.Id, 0)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	sendJson(userResponse{Id: user.Id, Email: user.Email}, http.StatusOK, w)
+func (ac *apiConfig) deleteFollowHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	if err := ac.db.Unfollow(r.Context(), user.Id, id); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
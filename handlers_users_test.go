@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpdateUserPreconditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		ifMatch string
+		body    string
+		want    int
+	}{
+		{"put without If-Match", http.MethodPut, "", `{"email":"sam@example.com","password":"correct-horse"}`, http.StatusPreconditionRequired},
+		{"put with a stale ETag", http.MethodPut, versionETag(0), `{"email":"sam@example.com","password":"correct-horse"}`, http.StatusPreconditionFailed},
+		{"put with the current ETag", http.MethodPut, versionETag(1), `{"email":"sam@example.com","password":"correct-horse"}`, http.StatusOK},
+		{"patch without If-Match", http.MethodPatch, "", `{"email":"sam@example.com"}`, http.StatusOK},
+		{"patch with a stale ETag", http.MethodPatch, versionETag(0), `{"email":"sam@example.com"}`, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := newTestAPI(t)
+			user, err := ac.db.CreateUser(context.Background(), "jo@example.com", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(tt.method, "/api/users", strings.NewReader(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			if tt.method == http.MethodPut {
+				ac.putUsersHandler(w, req)
+			} else {
+				ac.patchUsersHandler(w, req)
+			}
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+
+			stored, err := ac.db.FindUserById(context.Background(), user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed := stored.Email != user.Email
+			if changed != (tt.want == http.StatusOK) {
+				t.Errorf("email = %s after a %d", stored.Email, w.Code)
+			}
+			// PATCH leaves out the password, which stays as it was.
+			if tt.method == http.MethodPatch && stored.Password != user.Password {
+				t.Error("PATCH changed the password")
+			}
+		})
+	}
+}
+
+func TestHandleWebhooksKeepsConcurrentChanges(t *testing.T) {
+	ac := newTestAPI(t)
+	ac.polkaApiKey = "polka"
+	ctx := context.Background()
+	user, err := ac.db.CreateUser(ctx, "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user changes their email after the webhook was sent.
+	user.Email = "sam@example.com"
+	if _, err := ac.db.CompareAndSwapUser(ctx, user, user.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", strings.NewReader(`{"event":"user.upgraded","data":{"user_id":1}}`))
+	req.Header.Set("Authorization", "ApiKey polka")
+	w := httptest.NewRecorder()
+	ac.handleWebhooks(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+
+	stored, err := ac.db.FindUserById(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.ChirpyRed || stored.Email != "sam@example.com" || stored.Version != 3 {
+		t.Errorf("user = %+v, want Chirpy Red with the new email at version 3", stored)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", strings.NewReader(`{"event":"user.upgraded","data":{"user_id":42}}`))
+	req.Header.Set("Authorization", "ApiKey polka")
+	w = httptest.NewRecorder()
+	ac.handleWebhooks(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown user: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+type webhookBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type webhookResponse struct {
+	Id     int      `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret is only sent when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+func newWebhookResponse(webhook database.Webhook) webhookResponse {
+	return webhookResponse{Id: webhook.Id, URL: webhook.URL, Events: webhook.Events}
+}
+
+func (ac *apiConfig) postWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	body := webhookBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	v := validation.Validator{}
+	if v.Required("url", body.URL) {
+		u, err := url.Parse(body.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.AddError("url", validation.CodeInvalidFormat)
+		} else if !ac.webhookHostAllowed(u.Hostname()) {
+			v.AddError("url", validation.CodeInvalidFormat)
+		}
+	}
+	if len(body.Events) == 0 {
+		v.AddError("events", validation.CodeRequired)
+	}
+	for _, event := range body.Events {
+		if !slices.Contains(webhookEvents, event) {
+			v.AddError("events", validation.CodeInvalidFormat)
+			break
+		}
+	}
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	webhook, err := ac.db.CreateWebhook(r.Context(), user.Id, body.URL, hex.EncodeToString(secret), body.Events)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	response := newWebhookResponse(webhook)
+	response.Secret = webhook.Secret
+	sendResponse(response, http.StatusCreated, w, r)
+}
+
+func (ac *apiConfig) getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	webhooks, err := ac.db.GetWebhooks(r.Context(), user.Id)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	response := make([]webhookResponse, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		response = append(response, newWebhookResponse(webhook))
+	}
+	sendResponse(response, http.StatusOK, w, r)
+}
+
+func (ac *apiConfig) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	if err := ac.db.DeleteWebhook(r.Context(), id, user.Id); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhookDeliveriesHandler is the delivery log. Pass ?status=dead to get
+// the dead letter list.
+func (ac *apiConfig) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := ac.webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := ac.db.GetWebhookDeliveries(r.Context(), webhook.Id, r.URL.Query().Get("status"))
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(deliveries, http.StatusOK, w, r)
+}
+
+func (ac *apiConfig) retryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := ac.webhookFromRequest(w, r)
+	if !ok {
+		return
+	}
+	deliveryId, err := strconv.Atoi(chi.URLParam(r, "deliveryId"))
+	if err != nil {
+		handleErr(validation.NewErrors("deliveryId", validation.CodeInvalidFormat), w, r)
+		return
+	}
+	delivery, err := ac.db.RetryWebhookDelivery(r.Context(), deliveryId, webhook.Id)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		handleError(errDeliveryNotDead, w, r)
+		return
+	}
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	ac.enqueueWebhookDelivery(r.Context(), delivery)
+	sendResponse(delivery, http.StatusAccepted, w, r)
+}
+
+// webhookFromRequest loads the webhook in the {id} URL parameter, making sure
+// it belongs to the user. It responds with an error if it can't.
+func (ac *apiConfig) webhookFromRequest(w http.ResponseWriter, r *http.Request) (database.Webhook, bool) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return database.Webhook{}, false
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		handleErr(validation.NewErrors("id", validation.CodeInvalidFormat), w, r)
+		return database.Webhook{}, false
+	}
+	webhook, err := ac.db.GetWebhook(r.Context(), id, user.Id)
+	if err != nil {
+		handleErr(err, w, r)
+		return database.Webhook{}, false
+	}
+	return webhook, true
+}
+
+// webhookHostAllowed refuses webhook hosts that are addresses deliveries
+// would be refused for, so they're rejected when registering. Names are
+// only checked when delivering, since what they resolve to can change.
+func (ac *apiConfig) webhookHostAllowed(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		host = "127.0.0.1"
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	return webhookAddrAllowed(addr, ac.webhookNetworks)
+}
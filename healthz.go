@@ -1,13 +1,250 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func healthzCallback(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
-	return
+const (
+	// healthCheckTimeout bounds each readiness check, so a hung disk fails
+	// the probe instead of hanging it.
+	healthCheckTimeout = 2 * time.Second
+	// minFreeDisk is the least free space readiness accepts. Every write
+	// copies the whole database, so twice its size is required when that's
+	// more.
+	minFreeDisk = 64 << 20
+	// maxJobLag is how long a due job may wait before the queue counts as
+	// stuck.
+	maxJobLag = 5 * time.Minute
+	// healthCacheTTL is how long a readiness report is reused.
+	healthCacheTTL = 2 * time.Second
+
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Status    string                 `json:"status"`
+	LatencyMs float64                `json:"latency_ms"`
+	Error     string                 `json:"error,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// public returns the report without the errors and details of the checks.
+func (report healthReport) public() healthReport {
+	public := healthReport{Status: report.Status, Checks: make(map[string]healthCheck, len(report.Checks))}
+	for name, check := range report.Checks {
+		public.Checks[name] = healthCheck{Status: check.Status, LatencyMs: check.LatencyMs}
+	}
+	return public
+}
+
+// checkFunc runs one readiness check. The details are reported whether it
+// fails or not.
+type checkFunc func(ctx context.Context) (details map[string]interface{}, err error)
+
+var errDraining = errors.New("shutting down")
+
+// liveHandler is the liveness check. It only shows the process is serving
+// requests, dependencies failing is readiness' business, and restarting the
+// server wouldn't fix them.
+func (ac *apiConfig) liveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(healthReport{Status: healthOK}, http.StatusOK, w, r)
+}
+
+// readyHandler is the readiness check. It answers 503 when a check fails,
+// or once shutdown starts so load balancers stop sending traffic. Only the
+// status and latency of each check are sent, the errors and details, which
+// describe the server's internals, are at /admin/healthz.
+func (ac *apiConfig) readyHandler(w http.ResponseWriter, r *http.Request) {
+	report, status := ac.readiness(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(report.public(), status, w, r)
+}
+
+// adminHealthHandler sends the full readiness report, with the latency,
+// details and errors of each check.
+func (ac *apiConfig) adminHealthHandler(w http.ResponseWriter, r *http.Request) {
+	report, status := ac.readiness(r.Context())
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(report, status, w, r)
+}
+
+func (ac *apiConfig) readiness(ctx context.Context) (healthReport, int) {
+	if ac.draining.Load() {
+		// The database may already be closed, there's no point in
+		// checking it.
+		return healthReport{
+			Status: healthFail,
+			Checks: map[string]healthCheck{"shutdown": {Status: healthFail, Error: errDraining.Error()}},
+		}, http.StatusServiceUnavailable
+	}
+	report := ac.health.report(ctx, time.Now())
+	if report.Status != healthOK {
+		return report, http.StatusServiceUnavailable
+	}
+	return report, http.StatusOK
+}
+
+// healthChecker runs the readiness checks and reuses their report for
+// healthCacheTTL, so probes hitting the server often, or anyone else, can't
+// make it read the whole database and sync a file on every request.
+type healthChecker struct {
+	checks map[string]checkFunc
+	// running is set while a run of the check hasn't returned, which may
+	// be after it timed out.
+	running map[string]*atomic.Bool
+
+	mux       *sync.Mutex
+	last      healthReport
+	checkedAt time.Time
+}
+
+func newHealthChecker(checks map[string]checkFunc) *healthChecker {
+	running := make(map[string]*atomic.Bool)
+	for name := range checks {
+		running[name] = &atomic.Bool{}
+	}
+	return &healthChecker{
+		checks:  checks,
+		running: running,
+		mux:     &sync.Mutex{},
+	}
+}
+
+// report runs every check concurrently, unless the last report is recent
+// enough. Callers arriving while the checks run wait for them and share
+// their report.
+func (hc *healthChecker) report(ctx context.Context, now time.Time) healthReport {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if !hc.checkedAt.IsZero() && now.Sub(hc.checkedAt) < healthCacheTTL {
+		return hc.last
+	}
+
+	// The report is shared, so it shouldn't fail because the request that
+	// happened to run it went away.
+	ctx = context.WithoutCancel(ctx)
+	report := healthReport{Status: healthOK, Checks: make(map[string]healthCheck)}
+	mux := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for name, check := range hc.checks {
+		wg.Add(1)
+		go func(name string, check checkFunc) {
+			defer wg.Done()
+			result := runHealthCheck(ctx, hc.running[name], check)
+			mux.Lock()
+			defer mux.Unlock()
+			report.Checks[name] = result
+			if result.Status != healthOK {
+				report.Status = healthFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	hc.last = report
+	hc.checkedAt = time.Now()
+	return report
 }
 
+// runHealthCheck times check and gives up on it after healthCheckTimeout.
+// File operations don't take a context, so a timed out check keeps running
+// in the background until the file system answers. Until then it isn't run
+// again and fails right away, so a hung disk can't pile up goroutines.
+func runHealthCheck(ctx context.Context, running *atomic.Bool, check checkFunc) healthCheck {
+	if !running.CompareAndSwap(false, true) {
+		return healthCheck{Status: healthFail, Error: "previous check still running"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	type outcome struct {
+		details map[string]interface{}
+		err     error
+	}
+	start := time.Now()
+	done := make(chan outcome, 1)
+	go func() {
+		defer running.Store(false)
+		details, err := check(ctx)
+		done <- outcome{details, err}
+	}()
+
+	result := healthCheck{Status: healthOK}
+	select {
+	case o := <-done:
+		result.Details = o.details
+		if o.err != nil {
+			result.Status = healthFail
+			result.Error = o.err.Error()
+		}
+	case <-ctx.Done():
+		result.Status = healthFail
+		result.Error = "timed out"
+	}
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+func (ac *apiConfig) checkDatabaseRead(ctx context.Context) (map[string]interface{}, error) {
+	return nil, ac.db.Ping(ctx)
+}
+
+func (ac *apiConfig) checkDatabaseWrite(ctx context.Context) (map[string]interface{}, error) {
+	return nil, ac.db.PingWrite(ctx)
+}
+
+func (ac *apiConfig) checkDisk(ctx context.Context) (map[string]interface{}, error) {
+	free, err := diskFree(ac.config.DBPath)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return map[string]interface{}{"skipped": "not supported on this platform"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	size, err := ac.db.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	required := max(uint64(minFreeDisk), 2*uint64(size))
+	details := map[string]interface{}{
+		"free_bytes":     free,
+		"required_bytes": required,
+	}
+	if free < required {
+		return details, fmt.Errorf("only %d bytes free, %d required", free, required)
+	}
+	return details, nil
+}
+
+func (ac *apiConfig) checkJobs(ctx context.Context) (map[string]interface{}, error) {
+	stats := ac.jobs.Stats()
+	details := map[string]interface{}{
+		"queued":  stats.Queued,
+		"running": stats.Running,
+		"dead":    stats.Dead,
+		"lag_ms":  stats.Lag.Milliseconds(),
+	}
+	switch {
+	case !stats.Started:
+		return details, errors.New("workers aren't running")
+	case stats.SaveErr != nil:
+		return details, fmt.Errorf("couldn't write the queue file: %w", stats.SaveErr)
+	case stats.Lag > maxJobLag:
+		return details, fmt.Errorf("oldest due job has been waiting for %s", stats.Lag.Round(time.Second))
+	}
+	return details, nil
+}
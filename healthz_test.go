@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newHealthTest(t *testing.T) *apiConfig {
+	t.Helper()
+	ac := newTestAPI(t)
+	ac.health = newHealthChecker(map[string]checkFunc{
+		"database_read": ac.checkDatabaseRead,
+		"disk": func(ctx context.Context) (map[string]interface{}, error) {
+			return map[string]interface{}{"free_bytes": 1}, errors.New("only 1 bytes free in /var/lib/chirpy")
+		},
+	})
+	return ac
+}
+
+func TestReadyHandlerHidesInternals(t *testing.T) {
+	ac := newHealthTest(t)
+	w := httptest.NewRecorder()
+	ac.readyHandler(w, httptest.NewRequest(http.MethodGet, "/api/healthz/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "/var/lib/chirpy") || strings.Contains(w.Body.String(), "free_bytes") {
+		t.Errorf("body = %s, want no errors or details", w.Body)
+	}
+
+	report := healthReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != healthFail || len(report.Checks) != 2 {
+		t.Fatalf("report = %+v, want a failure with 2 checks", report)
+	}
+	if report.Checks["database_read"].Status != healthOK || report.Checks["disk"].Status != healthFail {
+		t.Errorf("checks = %+v, want database_read ok and disk failing", report.Checks)
+	}
+}
+
+func TestAdminHealthHandlerShowsInternals(t *testing.T) {
+	ac := newHealthTest(t)
+	w := httptest.NewRecorder()
+	ac.adminHealthHandler(w, httptest.NewRequest(http.MethodGet, "/admin/healthz", nil))
+
+	report := healthReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	disk := report.Checks["disk"]
+	if disk.Error == "" || disk.Details["free_bytes"] == nil {
+		t.Errorf("disk = %+v, want its error and details", disk)
+	}
+}
+
+func TestReadyHandlerWhileDraining(t *testing.T) {
+	ac := newHealthTest(t)
+	ac.draining.Store(true)
+	w := httptest.NewRecorder()
+	ac.readyHandler(w, httptest.NewRequest(http.MethodGet, "/api/healthz/ready", nil))
+	if w.Code != http.StatusServiceUnavailable || strings.Contains(w.Body.String(), errDraining.Error()) {
+		t.Errorf("status %d, body %s, want 503 without the error", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,380 @@
+// Package config loads the server configuration. Settings come from
+// defaults, then an optional YAML or TOML file, then environment variables
+// and finally command line flags, each overriding the ones before it.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/petomackay/chirpy/internal/jobs"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+type Config struct {
+	// Env is development or production, the default. The dev toolkit
+	// (resetting and seeding the database, debug mode) refuses to run in
+	// production, so it has to be turned on explicitly.
+	Env       string `yaml:"env" toml:"env"`
+	Port      int    `yaml:"port" toml:"port"`
+	PublicURL string `yaml:"public_url" toml:"public_url"`
+	DBPath    string `yaml:"db_path" toml:"db_path"`
+	// JobsPath defaults to jobs.json next to the database.
+	JobsPath string `yaml:"jobs_path" toml:"jobs_path"`
+	// StaticDir is served under /app. Everything in it is public, so the
+	// database, the job queue and the backups can't be kept in it.
+	StaticDir string `yaml:"static_dir" toml:"static_dir"`
+	// Debug deletes the database and job queue on startup.
+	Debug bool `yaml:"debug" toml:"debug"`
+	// LogLevel is debug, info, warn or error.
+	LogLevel string `yaml:"log_level" toml:"log_level"`
+	// LogFormat is text or json.
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+
+	JWTSecret   string `yaml:"jwt_secret" toml:"jwt_secret"`
+	PolkaAPIKey string `yaml:"polka_api_key" toml:"polka_api_key"`
+	AdminAPIKey string `yaml:"admin_api_key" toml:"admin_api_key"`
+
+	ChirpMaxLength        int    `yaml:"chirp_max_length" toml:"chirp_max_length"`
+	PasswordMinLength     int    `yaml:"password_min_length" toml:"password_min_length"`
+	BreachedPasswordsPath string `yaml:"breached_passwords_path" toml:"breached_passwords_path"`
+
+	Tokens  TokenConfig   `yaml:"tokens" toml:"tokens"`
+	Server  ServerConfig  `yaml:"server" toml:"server"`
+	Mail    MailConfig    `yaml:"mail" toml:"mail"`
+	Tracing TracingConfig `yaml:"tracing" toml:"tracing"`
+	Backup  BackupConfig  `yaml:"backup" toml:"backup"`
+
+	Webhooks WebhookConfig `yaml:"webhooks" toml:"webhooks"`
+}
+
+// TokenConfig holds token lifetimes.
+type TokenConfig struct {
+	AccessTTL    time.Duration `yaml:"access_ttl" toml:"access_ttl"`
+	RefreshTTL   time.Duration `yaml:"refresh_ttl" toml:"refresh_ttl"`
+	ChallengeTTL time.Duration `yaml:"challenge_ttl" toml:"challenge_ttl"`
+	VerifyTTL    time.Duration `yaml:"verify_ttl" toml:"verify_ttl"`
+	ResetTTL     time.Duration `yaml:"reset_ttl" toml:"reset_ttl"`
+}
+
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests and jobs get to
+	// finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// ShutdownDelay keeps serving after readiness fails, so load balancers
+	// can take the instance out first.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+}
+
+// MailConfig sends emails through SMTP when SMTPHost is set. Otherwise they
+// are appended to LogPath, or logged.
+type MailConfig struct {
+	SMTPHost     string `yaml:"smtp_host" toml:"smtp_host"`
+	SMTPPort     string `yaml:"smtp_port" toml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password"`
+	SMTPFrom     string `yaml:"smtp_from" toml:"smtp_from"`
+	LogPath      string `yaml:"log_path" toml:"log_path"`
+}
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP when Endpoint is
+// set, e.g. to http://localhost:4318 for a local collector.
+type TracingConfig struct {
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// SampleRatio is the share of new traces that are recorded. Requests
+	// continuing a trace follow the caller's decision.
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// BackupConfig takes backups of the database into Dir on Schedule, a cron
+// expression, and keeps the Keep newest. An empty Schedule turns scheduled
+// backups off.
+type BackupConfig struct {
+	// Dir defaults to backups next to the database.
+	Dir      string `yaml:"dir" toml:"dir"`
+	Schedule string `yaml:"schedule" toml:"schedule"`
+	Keep     int    `yaml:"keep" toml:"keep"`
+}
+
+// WebhookConfig limits where webhooks are delivered. Deliveries to loopback,
+// private and link-local addresses are refused, unless the address is in one
+// of AllowedNetworks, e.g. 127.0.0.0/8 for a receiver on the same machine.
+type WebhookConfig struct {
+	AllowedNetworks []string `yaml:"allowed_networks" toml:"allowed_networks"`
+}
+
+// AllowedPrefixes parses AllowedNetworks. A single address is a network of
+// its own.
+func (c WebhookConfig) AllowedPrefixes() ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, network := range c.AllowedNetworks {
+		if addr, err := netip.ParseAddr(network); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func Default() Config {
+	return Config{
+		Env:               EnvProduction,
+		Port:              8080,
+		DBPath:            "database.json",
+		StaticDir:         "static",
+		LogLevel:          "info",
+		LogFormat:         "text",
+		ChirpMaxLength:    140,
+		PasswordMinLength: 8,
+		Tokens: TokenConfig{
+			AccessTTL:    time.Hour,
+			RefreshTTL:   60 * time.Hour,
+			ChallengeTTL: 5 * time.Minute,
+			VerifyTTL:    24 * time.Hour,
+			ResetTTL:     time.Hour,
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Mail: MailConfig{
+			SMTPPort: "587",
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		Backup: BackupConfig{
+			Schedule: "@daily",
+			Keep:     7,
+		},
+	}
+}
+
+// Load builds the configuration from args (without the program name) and
+// the environment. The file is taken from the -config flag or CHIRPY_CONFIG.
+// A -h flag returns flag.ErrHelp after printing the usage.
+func Load(args []string) (Config, error) {
+	fs := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	cfg, err := LoadFlags(fs, args)
+	if err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cfg, nil
+}
+
+// LoadFlags is Load with the settings' flags added to fs, which may define
+// flags of its own, like those of a subcommand. The arguments left after the
+// flags are in fs.Args().
+func LoadFlags(fs *flag.FlagSet, args []string) (Config, error) {
+	configPath := fs.String("config", os.Getenv("CHIRPY_CONFIG"), "path to a YAML or TOML config file")
+
+	// Flags are parsed before the file and the environment are read, but
+	// must override them, so their values are applied at the end.
+	type flagValue struct {
+		s *setting
+		v string
+	}
+	flagValues := []flagValue{}
+	for i := range settings {
+		s := &settings[i]
+		if s.flag == "" {
+			continue
+		}
+		record := func(v string) error {
+			flagValues = append(flagValues, flagValue{s, v})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag, s.usage, record)
+		} else {
+			fs.Func(s.flag, s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if *configPath != "" {
+		if err := loadFile(*configPath, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && s.env != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+	for _, fv := range flagValues {
+		if err := fv.s.set(&cfg, fv.v); err != nil {
+			return Config{}, fmt.Errorf("invalid -%s: %w", fv.s.flag, err)
+		}
+	}
+
+	if cfg.JobsPath == "" {
+		cfg.JobsPath = filepath.Join(filepath.Dir(cfg.DBPath), "jobs.json")
+	}
+	if cfg.Backup.Dir == "" {
+		cfg.Backup.Dir = filepath.Join(filepath.Dir(cfg.DBPath), "backups")
+	}
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = fmt.Sprintf("http://localhost:%d", cfg.Port)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// loadFile decodes a YAML (.yaml, .yml) or TOML (.toml) file into cfg.
+// Unknown keys are errors, so typos don't go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(contents))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(contents), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format, use .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Production reports whether the server runs in production, where the dev
+// toolkit is disabled.
+func (c Config) Production() bool {
+	return c.Env == EnvProduction
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Env == EnvDevelopment || c.Env == EnvProduction, "env must be development or production, got %q", c.Env)
+	check(!(c.Production() && c.Debug), "debug can't be enabled in production")
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("public_url must be an absolute http(s) URL, got %q", c.PublicURL))
+	}
+	check(slices.Contains([]string{"debug", "info", "warn", "error"}, strings.ToLower(c.LogLevel)), "log_level must be debug, info, warn or error, got %q", c.LogLevel)
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format must be text or json, got %q", c.LogFormat)
+	check(c.DBPath != "", "db_path is required")
+	check(c.JobsPath != "", "jobs_path is required")
+	check(c.StaticDir != "", "static_dir is required")
+	for _, private := range []struct{ name, path string }{
+		{"db_path", c.DBPath},
+		{"jobs_path", c.JobsPath},
+		{"backup.dir", c.Backup.Dir},
+		{"mail.log_path", c.Mail.LogPath},
+	} {
+		check(private.path == "" || c.StaticDir == "" || !within(c.StaticDir, private.path), "%s can't be inside static_dir, everything there is served publicly", private.name)
+	}
+	check(c.JWTSecret != "", "jwt_secret is required")
+	check(c.ChirpMaxLength > 0, "chirp_max_length must be positive, got %d", c.ChirpMaxLength)
+	check(c.PasswordMinLength > 0, "password_min_length must be positive, got %d", c.PasswordMinLength)
+
+	check(c.Tokens.AccessTTL > 0, "tokens.access_ttl must be positive")
+	check(c.Tokens.RefreshTTL > 0, "tokens.refresh_ttl must be positive")
+	check(c.Tokens.ChallengeTTL > 0, "tokens.challenge_ttl must be positive")
+	check(c.Tokens.VerifyTTL > 0, "tokens.verify_ttl must be positive")
+	check(c.Tokens.ResetTTL > 0, "tokens.reset_ttl must be positive")
+	check(c.Tokens.RefreshTTL >= c.Tokens.AccessTTL, "tokens.refresh_ttl can't be shorter than tokens.access_ttl")
+
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout can't be negative")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout can't be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout can't be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout can't be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay can't be negative")
+
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint must be an absolute http(s) URL, got %q", c.Tracing.Endpoint))
+		}
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+
+	check(c.Backup.Dir != "", "backup.dir is required")
+	if c.Backup.Schedule != "" {
+		if _, err := jobs.ParseSchedule(c.Backup.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("backup.schedule: %w", err))
+		}
+	}
+	check(c.Backup.Keep > 0, "backup.keep must be positive, got %d", c.Backup.Keep)
+
+	if _, err := c.Webhooks.AllowedPrefixes(); err != nil {
+		errs = append(errs, fmt.Errorf("webhooks.allowed_networks: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// within reports whether path is dir or inside it.
+func within(dir string, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting ties a config field to its environment variable and flag. An
+// empty flag means the setting can't be passed on the command line, which
+// keeps secrets out of the process list.
+type setting struct {
+	env    string
+	flag   string
+	usage  string
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+var settings = []setting{
+	stringSetting("CHIRPY_ENV", "env", "production or development, the dev toolkit is only enabled in development", func(c *Config) *string { return &c.Env }),
+	intSetting("PORT", "port", "port to listen on", func(c *Config) *int { return &c.Port }),
+	stringSetting("PUBLIC_URL", "public-url", "URL used in links sent by email", func(c *Config) *string { return &c.PublicURL }),
+	stringSetting("DB_PATH", "db", "path of the database file", func(c *Config) *string { return &c.DBPath }),
+	stringSetting("JOBS_PATH", "jobs", "path of the job queue file", func(c *Config) *string { return &c.JobsPath }),
+	stringSetting("STATIC_DIR", "static", "directory served under /app", func(c *Config) *string { return &c.StaticDir }),
+	boolSetting("DEBUG", "debug", "delete the database and job queue on startup", func(c *Config) *bool { return &c.Debug }),
+	stringSetting("LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error", func(c *Config) *string { return &c.LogLevel }),
+	stringSetting("LOG_FORMAT", "log-format", "log output format: text or json", func(c *Config) *string { return &c.LogFormat }),
+
+	stringSetting("JWT_SECRET", "", "", func(c *Config) *string { return &c.JWTSecret }),
+	stringSetting("POLKA_API_KEY", "", "", func(c *Config) *string { return &c.PolkaAPIKey }),
+	stringSetting("ADMIN_API_KEY", "", "", func(c *Config) *string { return &c.AdminAPIKey }),
+
+	intSetting("CHIRP_MAX_LENGTH", "chirp-max-length", "maximum chirp length", func(c *Config) *int { return &c.ChirpMaxLength }),
+	intSetting("PASSWORD_MIN_LENGTH", "password-min-length", "minimum password length", func(c *Config) *int { return &c.PasswordMinLength }),
+	stringSetting("BREACHED_PASSWORDS_PATH", "breached-passwords", "file of breached passwords to reject, one per line", func(c *Config) *string { return &c.BreachedPasswordsPath }),
+
+	durationSetting("ACCESS_TOKEN_TTL", "access-token-ttl", "access token lifetime", func(c *Config) *time.Duration { return &c.Tokens.AccessTTL }),
+	durationSetting("REFRESH_TOKEN_TTL", "refresh-token-ttl", "refresh token lifetime", func(c *Config) *time.Duration { return &c.Tokens.RefreshTTL }),
+	durationSetting("CHALLENGE_TOKEN_TTL", "challenge-token-ttl", "2FA challenge token lifetime", func(c *Config) *time.Duration { return &c.Tokens.ChallengeTTL }),
+	durationSetting("VERIFY_TOKEN_TTL", "verify-token-ttl", "email verification token lifetime", func(c *Config) *time.Duration { return &c.Tokens.VerifyTTL }),
+	durationSetting("RESET_TOKEN_TTL", "reset-token-ttl", "password reset token lifetime", func(c *Config) *time.Duration { return &c.Tokens.ResetTTL }),
+
+	durationSetting("READ_HEADER_TIMEOUT", "read-header-timeout", "time allowed to read request headers", func(c *Config) *time.Duration { return &c.Server.ReadHeaderTimeout }),
+	durationSetting("READ_TIMEOUT", "read-timeout", "time allowed to read a request", func(c *Config) *time.Duration { return &c.Server.ReadTimeout }),
+	durationSetting("WRITE_TIMEOUT", "write-timeout", "time allowed to write a response", func(c *Config) *time.Duration { return &c.Server.WriteTimeout }),
+	durationSetting("IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections are kept", func(c *Config) *time.Duration { return &c.Server.IdleTimeout }),
+	durationSetting("SHUTDOWN_TIMEOUT", "shutdown-timeout", "time allowed for draining on shutdown", func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	durationSetting("SHUTDOWN_DELAY", "shutdown-delay", "how long to keep serving after readiness fails on shutdown", func(c *Config) *time.Duration { return &c.Server.ShutdownDelay }),
+
+	stringSetting("SMTP_HOST", "smtp-host", "SMTP server host, emails are only logged without it", func(c *Config) *string { return &c.Mail.SMTPHost }),
+	stringSetting("SMTP_PORT", "smtp-port", "SMTP server port", func(c *Config) *string { return &c.Mail.SMTPPort }),
+	stringSetting("SMTP_USERNAME", "smtp-username", "SMTP username", func(c *Config) *string { return &c.Mail.SMTPUsername }),
+	stringSetting("SMTP_PASSWORD", "", "", func(c *Config) *string { return &c.Mail.SMTPPassword }),
+	stringSetting("SMTP_FROM", "smtp-from", "sender address of emails", func(c *Config) *string { return &c.Mail.SMTPFrom }),
+	stringSetting("MAIL_LOG_PATH", "mail-log", "file emails are appended to when SMTP isn't configured", func(c *Config) *string { return &c.Mail.LogPath }),
+
+	stringSetting("TRACING_ENDPOINT", "tracing-endpoint", "OTLP/HTTP collector URL traces are exported to, tracing is off without it", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	floatSetting("TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "share of new traces that are recorded, between 0 and 1", func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+
+	stringSetting("BACKUP_DIR", "backup-dir", "directory of the database backups", func(c *Config) *string { return &c.Backup.Dir }),
+	stringSetting("BACKUP_SCHEDULE", "backup-schedule", "cron schedule of database backups, empty to turn them off", func(c *Config) *string { return &c.Backup.Schedule }),
+	intSetting("BACKUP_KEEP", "backup-keep", "number of database backups kept", func(c *Config) *int { return &c.Backup.Keep }),
+
+	listSetting("WEBHOOK_ALLOWED_NETWORKS", "webhook-allowed-networks", "comma separated private networks webhooks may be delivered to, e.g. 127.0.0.0/8", func(c *Config) *[]string { return &c.Webhooks.AllowedNetworks }),
+}
+
+func stringSetting(env string, flag string, usage string, field func(c *Config) *string) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(env string, flag string, usage string, field func(c *Config) *int) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(env string, flag string, usage string, field func(c *Config) *bool) setting {
+	return setting{env: env, flag: flag, usage: usage, isBool: true, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func floatSetting(env string, flag string, usage string, field func(c *Config) *float64) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = f
+		return nil
+	}}
+}
+
+// listSetting splits comma separated values, ignoring empty ones.
+func listSetting(env string, flag string, usage string, field func(c *Config) *[]string) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, v string) error {
+		list := []string{}
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}}
+}
+
+func durationSetting(env string, flag string, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{env: env, flag: flag, usage: usage, set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}}
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the UTC time in backup names. It sorts like the times
+// it formats.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// ErrInvalidSnapshot is returned by Restore for contents that aren't a
+// database file.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// BackupInfo describes a backup file in a backup directory.
+type BackupInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// CreatedAt is in unix milliseconds.
+	CreatedAt int64 `json:"created_at"`
+}
+
+// snapshot returns the contents of the file. Writes replace the file whole
+// under the write lock, so the contents are consistent, and writes only wait
+// for the read, not for the caller to store them.
+func (db *DB) snapshot(ctx context.Context) (contents []byte, err error) {
+	ctx, span := db.startFileSpan(ctx, "read")
+	start := time.Now()
+	defer func() {
+		db.observe(ctx, "read", start, err)
+		endSpan(span, err)
+	}()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	return os.ReadFile(db.path)
+}
+
+// Backup writes a consistent snapshot of the database to w, without
+// stopping writes. The snapshot is a copy of the file, which Restore takes
+// back.
+func (db *DB) Backup(ctx context.Context, w io.Writer) (_ int64, err error) {
+	ctx, span := db.startSpan(ctx, "Backup")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	contents, err := db.snapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(contents)
+	return int64(n), err
+}
+
+// BackupToDir stores a snapshot in dir under a name made of the database
+// file's name and now. dir is created if needed, readable by the owner only
+// since backups hold every password hash and secret. The backup is written
+// through a synced temporary file, so a crash can't leave half of one
+// behind. It never replaces an existing backup: when one has the same name,
+// a counter is added to the new one, e.g. database-20240102T150405.000Z-1.json.
+func (db *DB) BackupToDir(ctx context.Context, dir string, now time.Time) (_ BackupInfo, err error) {
+	ctx, span := db.startSpan(ctx, "BackupToDir")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	contents, err := db.snapshot(ctx)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return BackupInfo{}, err
+	}
+
+	tmp, err := os.CreateTemp(dir, db.backupPrefix()+"*.tmp")
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return BackupInfo{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return BackupInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return BackupInfo{}, err
+	}
+
+	now = now.UTC()
+	stamp := now.Format(backupTimeFormat)
+	info := BackupInfo{
+		Size:      int64(len(contents)),
+		CreatedAt: now.UnixMilli(),
+	}
+	// Unlike a rename, a link fails if the name is taken.
+	for seq := 0; ; seq++ {
+		info.Name = db.backupPrefix() + stamp + ".json"
+		if seq > 0 {
+			info.Name = fmt.Sprintf("%s%s-%d.json", db.backupPrefix(), stamp, seq)
+		}
+		err := os.Link(tmp.Name(), filepath.Join(dir, info.Name))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return BackupInfo{}, err
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// Backups lists the backups of this database in dir, newest first. Other
+// files are ignored, and a missing dir has no backups.
+func (db *DB) Backups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	type backup struct {
+		info BackupInfo
+		seq  int
+	}
+	backups := []backup{}
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), db.backupPrefix())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		stamp, ok = strings.CutSuffix(stamp, ".json")
+		if !ok {
+			continue
+		}
+		seq := 0
+		if i := strings.LastIndex(stamp, "Z-"); i >= 0 {
+			if seq, err = strconv.Atoi(stamp[i+2:]); err != nil || seq < 1 {
+				continue
+			}
+			stamp = stamp[:i+1]
+		}
+		createdAt, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup{
+			info: BackupInfo{
+				Name:      entry.Name(),
+				Size:      fileInfo.Size(),
+				CreatedAt: createdAt.UnixMilli(),
+			},
+			seq: seq,
+		})
+	}
+	slices.SortFunc(backups, func(a, b backup) int {
+		if a.info.CreatedAt != b.info.CreatedAt {
+			return cmp.Compare(b.info.CreatedAt, a.info.CreatedAt)
+		}
+		return b.seq - a.seq
+	})
+	infos := make([]BackupInfo, 0, len(backups))
+	for _, backup := range backups {
+		infos = append(infos, backup.info)
+	}
+	return infos, nil
+}
+
+// PruneBackups deletes all but the keep newest backups in dir and returns
+// the names of the deleted ones.
+func (db *DB) PruneBackups(dir string, keep int) ([]string, error) {
+	backups, err := db.Backups(dir)
+	if err != nil {
+		return nil, err
+	}
+	pruned := []string{}
+	for _, backup := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(filepath.Join(dir, backup.Name)); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, backup.Name)
+	}
+	return pruned, nil
+}
+
+// backupPrefix starts the name of every backup of this database, e.g.
+// "database-" for database.json.
+func (db *DB) backupPrefix() string {
+	name := filepath.Base(db.path)
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "-"
+}
+
+// Restore replaces the database with a snapshot taken by Backup. Snapshots
+// of older versions are migrated, those of newer versions are refused with
+// ErrNewerSchema. The snapshot must be a JSON object with only the keys
+// this version knows, otherwise ErrInvalidSnapshot is returned and nothing
+// changes. It doesn't look for inconsistencies, run CheckSnapshot first for
+// that. No events are published.
+func (db *DB) Restore(ctx context.Context, snapshot []byte) (err error) {
+	ctx, span := db.startSpan(ctx, "Restore")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := parseSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.writeFile(ctx, dbStruct)
+}
+
+// ValidateSnapshot returns the error Restore would return for snapshot's
+// format, without restoring it.
+func ValidateSnapshot(snapshot []byte) error {
+	_, err := parseSnapshot(snapshot)
+	return err
+}
+
+// parseSnapshot upgrades snapshot to SchemaVersion and decodes it strictly:
+// a single JSON object without unknown keys.
+func parseSnapshot(snapshot []byte) (DBStructure, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(snapshot), []byte("{")) {
+		return DBStructure{}, fmt.Errorf("%w: not a JSON object", ErrInvalidSnapshot)
+	}
+	snapshot, _, err := upgrade(snapshot)
+	if errors.Is(err, ErrNewerSchema) {
+		return DBStructure{}, err
+	}
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(snapshot))
+	dec.DisallowUnknownFields()
+	dbStruct := DBStructure{}
+	if err := dec.Decode(&dbStruct); err != nil {
+		return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return DBStructure{}, fmt.Errorf("%w: data after the JSON object", ErrInvalidSnapshot)
+	}
+	dbStruct.ensureMaps()
+	return dbStruct, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupToDirKeepsBackupsTakenAtTheSameTime(t *testing.T) {
+	path, migrationDir := writeTestFile(t, baselineFile)
+	db, err := NewDB(path, migrationDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	backupDir := t.TempDir()
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	names := []string{}
+	for i := 0; i < 11; i++ {
+		info, err := db.BackupToDir(context.Background(), backupDir, now)
+		if err != nil {
+			t.Fatalf("backup %d: %v", i+1, err)
+		}
+		names = append(names, info.Name)
+	}
+	if names[0] != "database-20240102T150405.000Z.json" || names[1] != "database-20240102T150405.000Z-1.json" {
+		t.Errorf("names = %v, want a counter added after the first", names)
+	}
+
+	backups, err := db.Backups(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != len(names) {
+		t.Fatalf("got %d backups, want %d", len(backups), len(names))
+	}
+	// Newest first, so the counters count down, 10 before 9.
+	for i, backup := range backups {
+		if want := names[len(names)-1-i]; backup.Name != want {
+			t.Errorf("backup %d = %s, want %s", i, backup.Name, want)
+		}
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			t.Errorf("left %s behind", entry.Name())
+		}
+	}
+}
@@ -1,94 +1,365 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/petomackay/chirpy/internal/pubsub"
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path   string
+	mux    *sync.RWMutex
+	events *pubsub.Hub
+	// closed is guarded by mux.
+	closed   bool
+	observer Observer
 }
 
+// Observer is told how long every read and write of the database file took.
+// op is "read" or "write" and ctx is the context of the calling method.
+type Observer func(ctx context.Context, op string, duration time.Duration, err error)
+
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpUpdated = "chirp.updated"
+	EventChirpDeleted = "chirp.deleted"
+	EventChirpLiked   = "chirp.liked"
+	EventNotification = "notification"
+
+	eventBufferSize = 1000
+)
+
 type User struct {
-	Id        int    `json:"id"`
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	ChirpyRed bool   `json:"is_chirpy_red"`
+	Id            int      `json:"id"`
+	Email         string   `json:"email"`
+	Password      string   `json:"password"`
+	ChirpyRed     bool     `json:"is_chirpy_red"`
+	EmailVerified bool     `json:"email_verified"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// TOTPPendingSecret is the secret of an enrolment that hasn't been
+	// confirmed with a code yet. It becomes TOTPSecret once it is.
+	TOTPPendingSecret string `json:"totp_pending_secret,omitempty"`
+	// NotificationPrefs turns notification types off. Types that aren't
+	// listed are on.
+	NotificationPrefs map[string]bool `json:"notification_preferences,omitempty"`
+	Version           int             `json:"version"`
+	// CreatedAt is in unix milliseconds, zero for users created before it
+	// was recorded.
+	CreatedAt int64 `json:"created_at,omitempty"`
+	// TokenGeneration is bumped to revoke every token issued to the user.
+	// Tokens carry the generation they were issued in, and those of earlier
+	// generations are rejected.
+	TokenGeneration int `json:"token_generation,omitempty"`
+}
+
+func (u User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
 }
 
 type Chirp struct {
-	Id     int    `json:"id"`
-	Body   string `json:"body"`
-	UserId int    `json:"author_id"`
+	Id      int    `json:"id"`
+	Body    string `json:"body"`
+	UserId  int    `json:"author_id"`
+	ReplyTo int    `json:"reply_to,omitempty"`
+	Version int    `json:"version"`
+	// CreatedAt is in unix milliseconds, zero for chirps created before it
+	// was recorded.
+	CreatedAt int64 `json:"created_at,omitempty"`
+}
+
+// Like is the data of EventChirpLiked events.
+type Like struct {
+	ChirpId  int `json:"chirp_id"`
+	AuthorId int `json:"author_id"`
+	UserId   int `json:"user_id"`
+}
+
+// LoginAttempt tracks failed logins for a single throttling key (an IP
+// address or an account). Timestamps are unix milliseconds.
+type LoginAttempt struct {
+	Failures    int   `json:"failures"`
+	LastFailure int64 `json:"last_failure"`
+	LockedUntil int64 `json:"locked_until"`
 }
 
 type DBStructure struct {
-	Chirps  map[int]Chirp    `json:"chirps"`
-	Users   map[int]User     `json:"users"`
-	Revoked map[string]int64 `json:"revoked"`
+	// SchemaVersion is the version of the file format, see SchemaVersion.
+	SchemaVersion int `json:"schema_version"`
+
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	Revoked       map[string]int64        `json:"revoked"`
+	LoginAttempts map[string]LoginAttempt `json:"login_attempts"`
+	Likes         map[int][]int           `json:"likes"`
+	Follows       map[int][]int           `json:"follows"`
+	Notifications map[int]Notification    `json:"notifications"`
+
+	Webhooks          map[int]Webhook         `json:"webhooks"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhook_deliveries"`
+
+	LastUserId     int `json:"last_user_id"`
+	LastChirpId    int `json:"last_chirp_id"`
+	LastNotifId    int `json:"last_notification_id"`
+	LastWebhookId  int `json:"last_webhook_id"`
+	LastDeliveryId int `json:"last_delivery_id"`
 }
 
 var ErrAlreadyExists = errors.New("already exists")
 var ErrNotExist = errors.New("does not exist")
 
-func NewDB(path string) (*DB, error) {
+// ErrVersionMismatch is returned by the compare-and-swap methods when the
+// stored record has changed since the caller read it.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrAlreadyUsed is returned when a single-use code or token is used again.
+var ErrAlreadyUsed = errors.New("already used")
+
+// ErrClosed is returned by writes after Close.
+var ErrClosed = errors.New("database is closed")
+
+// NewDB opens the database at path, creating it if needed. Files of older
+// versions are migrated after being backed up to backupDir.
+func NewDB(path string, backupDir string) (*DB, error) {
 	db := DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:   path,
+		mux:    &sync.RWMutex{},
+		events: pubsub.NewHub(eventBufferSize),
 	}
 	if err := db.ensureDB(); err != nil {
 		return nil, err
 	}
+	if err := db.migrate(backupDir); err != nil {
+		return nil, err
+	}
 	return &db, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	if _, err := db.FindUserByEmail(email); !errors.Is(err, ErrNotExist) {
-		return User{}, ErrAlreadyExists
+// SetObserver installs an observer for file operations. It must be called
+// before the database is used concurrently.
+func (db *DB) SetObserver(observer Observer) {
+	db.observer = observer
+}
+
+func (db *DB) observe(ctx context.Context, op string, start time.Time, err error) {
+	if db.observer != nil {
+		db.observer(ctx, op, time.Since(start), err)
 	}
+}
 
-	dbStruct, err := db.loadDB()
+// Size returns the size of the database file in bytes.
+func (db *DB) Size() (int64, error) {
+	info, err := os.Stat(db.path)
 	if err != nil {
-		log.Println("Couldn't load DB: " + err.Error())
-		return User{}, err
+		return 0, err
 	}
+	return info.Size(), nil
+}
+
+// Ping reads and decodes the database file.
+func (db *DB) Ping(ctx context.Context) (err error) {
+	ctx, span := db.startSpan(ctx, "Ping")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	_, err = db.loadDB(ctx)
+	return err
+}
 
-	id := len(dbStruct.Users) + 1
+// PingWrite checks that writes can still land by writing, syncing and
+// removing a probe file next to the database. The database itself isn't
+// touched, so the check can't race with real writes.
+func (db *DB) PingWrite(ctx context.Context) (err error) {
+	ctx, span := db.startSpan(ctx, "PingWrite")
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	user := User{
-		Id:        id,
-		Email:     email,
-		Password:  password,
-		ChirpyRed: false,
+	db.mux.RLock()
+	closed := db.closed
+	db.mux.RUnlock()
+	if closed {
+		return ErrClosed
 	}
-	dbStruct.Users[id] = user
-	if err := db.writeDB(dbStruct); err != nil {
-		return User{}, nil
+
+	probe := db.path + ".probe"
+	f, err := os.OpenFile(probe, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(probe)
+	if _, err := f.Write([]byte("{}")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Events returns the hub receiving an event for every chirp change. The data
+// of each event is the affected Chirp, a Like for EventChirpLiked or a
+// Notification for EventNotification.
+func (db *DB) Events() *pubsub.Hub {
+	return db.events
+}
+
+func (db *DB) CreateUser(ctx context.Context, email string, password string) (_ User, err error) {
+	ctx, span := db.startSpan(ctx, "CreateUser")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	user := User{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		for _, existing := range dbStruct.Users {
+			if existing.Email == email {
+				return ErrAlreadyExists
+			}
+		}
+
+		user = User{
+			Id:        nextId(dbStruct.Users, &dbStruct.LastUserId),
+			Email:     email,
+			Password:  password,
+			ChirpyRed: false,
+			Version:   1,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+		dbStruct.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 	return user, nil
 }
 
-func (db *DB) UpdateUser(user User) error {
-	dbStruct, err := db.loadDB()
+// CompareAndSwapUser stores user only if the stored version still equals
+// version, and returns the user with its new version.
+func (db *DB) CompareAndSwapUser(ctx context.Context, user User, version int) (_ User, err error) {
+	ctx, span := db.startSpan(ctx, "CompareAndSwapUser")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		stored, ok := dbStruct.Users[user.Id]
+		if !ok {
+			return ErrNotExist
+		}
+		if stored.Version != version {
+			return ErrVersionMismatch
+		}
+		user.Version = version + 1
+		user.CreatedAt = stored.CreatedAt
+		user.TokenGeneration = max(user.TokenGeneration, stored.TokenGeneration)
+		dbStruct.Users[user.Id] = user
+		return nil
+	})
 	if err != nil {
-		log.Println("Couldn't load DB: " + err.Error())
-		return err
+		return User{}, err
 	}
-	dbStruct.Users[user.Id] = user
-	err = db.writeDB(dbStruct)
-	return err
+	return user, nil
+}
 
+// SetChirpyRed turns Chirpy Red on or off for the user and returns the
+// updated user. Only that field is written, so it can't undo a concurrent
+// change to the rest of the user.
+func (db *DB) SetChirpyRed(ctx context.Context, userId int, red bool) (_ User, err error) {
+	ctx, span := db.startSpan(ctx, "SetChirpyRed")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	user := User{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		var ok bool
+		user, ok = dbStruct.Users[userId]
+		if !ok {
+			return ErrNotExist
+		}
+		user.ChirpyRed = red
+		user.Version++
+		dbStruct.Users[userId] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// UseTOTPStep records step as the last TOTP step the user logged in with.
+// Steps at or before the recorded one return ErrAlreadyUsed, so each code
+// logs in once even when requests race.
+func (db *DB) UseTOTPStep(ctx context.Context, userId int, step int64) (err error) {
+	ctx, span := db.startSpan(ctx, "UseTOTPStep")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userId]
+		if !ok {
+			return ErrNotExist
+		}
+		if step <= user.TOTPLastStep {
+			return ErrAlreadyUsed
+		}
+		user.TOTPLastStep = step
+		user.Version++
+		dbStruct.Users[userId] = user
+		return nil
+	})
+}
+
+// UseRecoveryCode removes the recovery code with the given hash from the
+// user. A hash the user doesn't have, because it was never issued or was
+// already used, returns ErrAlreadyUsed.
+func (db *DB) UseRecoveryCode(ctx context.Context, userId int, hash string) (err error) {
+	ctx, span := db.startSpan(ctx, "UseRecoveryCode")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userId]
+		if !ok {
+			return ErrNotExist
+		}
+		idx := slices.Index(user.RecoveryCodes, hash)
+		if idx < 0 {
+			return ErrAlreadyUsed
+		}
+		user.RecoveryCodes = slices.Delete(user.RecoveryCodes, idx, idx+1)
+		user.Version++
+		dbStruct.Users[userId] = user
+		return nil
+	})
 }
-func (db *DB) FindUserByEmail(email string) (User, error) {
-	dbStruct, err := db.loadDB()
+
+func (db *DB) FindUserByEmail(ctx context.Context, email string) (_ User, err error) {
+	ctx, span := db.startSpan(ctx, "FindUserByEmail")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
-		log.Println("Coudln't load DB: " + err.Error())
-		return User{}, nil
+		slog.ErrorContext(ctx, "Couldn't load the database", "err", err)
+		return User{}, err
 	}
 
 	for _, user := range dbStruct.Users {
@@ -99,45 +370,113 @@ func (db *DB) FindUserByEmail(email string) (User, error) {
 	return User{}, ErrNotExist
 }
 
-func (db *DB) FindUserById(id int) (User, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) FindUserById(ctx context.Context, id int) (_ User, err error) {
+	ctx, span := db.startSpan(ctx, "FindUserById")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
-		log.Println("Coudln't load DB: " + err.Error())
-		return User{}, nil
+		slog.ErrorContext(ctx, "Couldn't load the database", "err", err)
+		return User{}, err
 	}
 
 	if user, ok := dbStruct.Users[id]; ok {
-		log.Println("found user")
 		return user, nil
 	}
-	log.Printf("didn't find user with id, %d\n", id)
+	slog.DebugContext(ctx, "Didn't find user", "user_id", id)
 	return User{}, ErrNotExist
 }
 
-func (db *DB) CreateChirp(body string, userId int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+// GetUsers returns every user, sorted by id.
+func (db *DB) GetUsers(ctx context.Context) (_ []User, err error) {
+	ctx, span := db.startSpan(ctx, "GetUsers")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
-		log.Println("Couldn't loadDB: " + err.Error())
-		return Chirp{}, err
+		return nil, err
 	}
-
-	id := len(dbStruct.Chirps) + 1
-	chirp := Chirp{
-		Id:     id,
-		Body:   body,
-		UserId: userId,
+	users := make([]User, 0, len(dbStruct.Users))
+	for _, user := range dbStruct.Users {
+		users = append(users, user)
 	}
+	slices.SortFunc(users, func(a, b User) int { return a.Id - b.Id })
+	return users, nil
+}
 
-	dbStruct.Chirps[id] = chirp
+// CreateChirp stores a new chirp. replyTo is the id of the chirp it replies
+// to, or 0.
+func (db *DB) CreateChirp(ctx context.Context, body string, userId int, replyTo int) (_ Chirp, err error) {
+	ctx, span := db.startSpan(ctx, "CreateChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	chirp := Chirp{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps[replyTo]; replyTo != 0 && !ok {
+			return ErrNotExist
+		}
+		chirp = Chirp{
+			Id:        nextId(dbStruct.Chirps, &dbStruct.LastChirpId),
+			Body:      body,
+			UserId:    userId,
+			ReplyTo:   replyTo,
+			Version:   1,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+		dbStruct.Chirps[chirp.Id] = chirp
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotExist) {
+			slog.ErrorContext(ctx, "Couldn't create chirp", "err", err)
+		}
+		return Chirp{}, err
+	}
+	db.events.Publish(EventChirpCreated, chirp)
+	return chirp, nil
+}
 
-	if err := db.writeDB(dbStruct); err != nil {
+// CompareAndSwapChirp stores chirp only if the stored version still equals
+// version, and returns the chirp with its new version.
+func (db *DB) CompareAndSwapChirp(ctx context.Context, chirp Chirp, version int) (_ Chirp, err error) {
+	ctx, span := db.startSpan(ctx, "CompareAndSwapChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		stored, ok := dbStruct.Chirps[chirp.Id]
+		if !ok {
+			return ErrNotExist
+		}
+		if stored.Version != version {
+			return ErrVersionMismatch
+		}
+		chirp.Version = version + 1
+		chirp.CreatedAt = stored.CreatedAt
+		dbStruct.Chirps[chirp.Id] = chirp
+		return nil
+	})
+	if err != nil {
 		return Chirp{}, err
 	}
+	db.events.Publish(EventChirpUpdated, chirp)
 	return chirp, nil
 }
 
-func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) GetChirp(ctx context.Context, id int) (_ Chirp, err error) {
+	ctx, span := db.startSpan(ctx, "GetChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -145,20 +484,149 @@ func (db *DB) GetChirp(id int) (Chirp, error) {
 	if ok {
 		return chirp, nil
 	}
-	return Chirp{}, errors.New("Chirp not found.")
+	return Chirp{}, ErrNotExist
+}
+
+func (db *DB) DeleteChirp(ctx context.Context, id int) (err error) {
+	ctx, span := db.startSpan(ctx, "DeleteChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	deleted := Chirp{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		stored, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+		deleted = stored
+		delete(dbStruct.Chirps, id)
+		delete(dbStruct.Likes, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.events.Publish(EventChirpDeleted, deleted)
+	return nil
 }
 
-func (db *DB) DeleteChirp(id int) error {
-	dbStruct, err := db.loadDB()
+// CompareAndDeleteChirp deletes the chirp only if the stored version still
+// equals version.
+func (db *DB) CompareAndDeleteChirp(ctx context.Context, id int, version int) (err error) {
+	ctx, span := db.startSpan(ctx, "CompareAndDeleteChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	deleted := Chirp{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		stored, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrNotExist
+		}
+		if stored.Version != version {
+			return ErrVersionMismatch
+		}
+		deleted = stored
+		delete(dbStruct.Chirps, id)
+		delete(dbStruct.Likes, id)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	delete(dbStruct.Chirps, id)
+	db.events.Publish(EventChirpDeleted, deleted)
 	return nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStruct, err := db.loadDB()
+// LikeChirp records that userId likes the chirp. Liking a chirp twice
+// returns ErrAlreadyExists.
+func (db *DB) LikeChirp(ctx context.Context, chirpId int, userId int) (err error) {
+	ctx, span := db.startSpan(ctx, "LikeChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	like := Like{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[chirpId]
+		if !ok {
+			return ErrNotExist
+		}
+		if slices.Contains(dbStruct.Likes[chirpId], userId) {
+			return ErrAlreadyExists
+		}
+		dbStruct.Likes[chirpId] = append(dbStruct.Likes[chirpId], userId)
+		like = Like{ChirpId: chirpId, AuthorId: chirp.UserId, UserId: userId}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.events.Publish(EventChirpLiked, like)
+	return nil
+}
+
+func (db *DB) UnlikeChirp(ctx context.Context, chirpId int, userId int) (err error) {
+	ctx, span := db.startSpan(ctx, "UnlikeChirp")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		idx := slices.Index(dbStruct.Likes[chirpId], userId)
+		if idx < 0 {
+			return ErrNotExist
+		}
+		dbStruct.Likes[chirpId] = slices.Delete(dbStruct.Likes[chirpId], idx, idx+1)
+		return nil
+	})
+}
+
+// Follow makes followerId follow followeeId. Following someone twice
+// returns ErrAlreadyExists.
+func (db *DB) Follow(ctx context.Context, followerId int, followeeId int) (err error) {
+	ctx, span := db.startSpan(ctx, "Follow")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[followeeId]; !ok {
+			return ErrNotExist
+		}
+		if slices.Contains(dbStruct.Follows[followerId], followeeId) {
+			return ErrAlreadyExists
+		}
+		dbStruct.Follows[followerId] = append(dbStruct.Follows[followerId], followeeId)
+		return nil
+	})
+}
+
+func (db *DB) Unfollow(ctx context.Context, followerId int, followeeId int) (err error) {
+	ctx, span := db.startSpan(ctx, "Unfollow")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		idx := slices.Index(dbStruct.Follows[followerId], followeeId)
+		if idx < 0 {
+			return ErrNotExist
+		}
+		dbStruct.Follows[followerId] = slices.Delete(dbStruct.Follows[followerId], idx, idx+1)
+		return nil
+	})
+}
+
+func (db *DB) GetChirps(ctx context.Context) (_ []Chirp, err error) {
+	ctx, span := db.startSpan(ctx, "GetChirps")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -169,8 +637,13 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 	return chirps, nil
 }
 
-func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
-	dbStruct, err := db.loadDB()
+func (db *DB) GetChirpsByAuthor(ctx context.Context, authorId int) (_ []Chirp, err error) {
+	ctx, span := db.startSpan(ctx, "GetChirpsByAuthor")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -185,72 +658,324 @@ func (db *DB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
 
 func (db *DB) ensureDB() error {
 	if _, err := os.ReadFile(db.path); errors.Is(err, os.ErrNotExist) {
-		log.Printf("The DB file %s does not exist. Attempting to create it.\n", db.path)
+		slog.Info("The DB file does not exist, attempting to create it", "path", db.path)
 		if _, err := os.Create(db.path); err != nil {
-			log.Printf("Couldn't create file %s\n", db.path)
+			slog.Error("Couldn't create the DB file", "path", db.path, "err", err)
 			return err
 		}
-		emptyStruct := DBStructure{
-			Chirps:  make(map[int]Chirp),
-			Users:   make(map[int]User),
-			Revoked: make(map[string]int64),
-		}
-		if err := db.writeDB(emptyStruct); err != nil {
-			log.Println("Error when initializing the DB: " + err.Error())
+		emptyStruct := DBStructure{}
+		emptyStruct.ensureMaps()
+		if err := db.writeDB(context.Background(), emptyStruct); err != nil {
+			slog.Error("Couldn't initialize the DB", "path", db.path, "err", err)
 			return err
 		}
 	}
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
+func (db *DB) loadDB(ctx context.Context) (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.readFile(ctx)
+}
+
+func (db *DB) readFile(ctx context.Context) (dbStruct DBStructure, err error) {
+	ctx, span := db.startFileSpan(ctx, "read")
+	start := time.Now()
+	defer func() {
+		db.observe(ctx, "read", start, err)
+		endSpan(span, err)
+	}()
+
 	contents, err := os.ReadFile(db.path)
 	if err != nil {
-		log.Println("Couldn't read DB file: " + err.Error())
+		slog.ErrorContext(ctx, "Couldn't read the DB file", "path", db.path, "err", err)
 		return DBStructure{}, err
 	}
 
-	dbStruct := DBStructure{}
 	if err := json.Unmarshal(contents, &dbStruct); err != nil {
-		log.Println("Couldn't unmarshall DB file: " + err.Error())
+		slog.ErrorContext(ctx, "Couldn't unmarshal the DB file", "path", db.path, "err", err)
 		return DBStructure{}, err
 	}
+	// NewDB migrated the file, a newer version must have replaced it since.
+	if err := checkSchemaVersion(dbStruct.SchemaVersion); err != nil {
+		slog.ErrorContext(ctx, "Couldn't read the DB file", "path", db.path, "err", err)
+		return DBStructure{}, err
+	}
+	dbStruct.ensureMaps()
 	return dbStruct, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// ensureMaps initializes the maps missing from files written before they
+// were added.
+func (s *DBStructure) ensureMaps() {
+	if s.Chirps == nil {
+		s.Chirps = make(map[int]Chirp)
+	}
+	if s.Users == nil {
+		s.Users = make(map[int]User)
+	}
+	if s.Revoked == nil {
+		s.Revoked = make(map[string]int64)
+	}
+	if s.LoginAttempts == nil {
+		s.LoginAttempts = make(map[string]LoginAttempt)
+	}
+	if s.Likes == nil {
+		s.Likes = make(map[int][]int)
+	}
+	if s.Follows == nil {
+		s.Follows = make(map[int][]int)
+	}
+	if s.Notifications == nil {
+		s.Notifications = make(map[int]Notification)
+	}
+	if s.Webhooks == nil {
+		s.Webhooks = make(map[int]Webhook)
+	}
+	if s.WebhookDeliveries == nil {
+		s.WebhookDeliveries = make(map[int]WebhookDelivery)
+	}
+}
+
+func (db *DB) writeDB(ctx context.Context, dbStructure DBStructure) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dat, err := json.Marshal(dbStructure)
+	return db.writeFile(ctx, dbStructure)
+}
+
+// update runs fn on the current contents and writes the result back while
+// holding the write lock, so no other write can slip in between. Nothing is
+// written if fn returns an error.
+func (db *DB) update(ctx context.Context, fn func(dbStruct *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStruct, err := db.readFile(ctx)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(db.path, dat, 0666); err != nil {
+	if err := fn(&dbStruct); err != nil {
 		return err
 	}
-	return nil
+	return db.writeFile(ctx, dbStruct)
 }
 
-func (db *DB) RevokeToken(tokenString string) error {
-	t := time.Now().UnixMilli()
-	dbStruct, err := db.loadDB()
+// writeFile replaces the file through a synced temporary file, so a crash
+// or a kill mid-write leaves either the old or the new contents behind.
+// Callers hold the write lock.
+func (db *DB) writeFile(ctx context.Context, dbStructure DBStructure) (err error) {
+	ctx, span := db.startFileSpan(ctx, "write")
+	start := time.Now()
+	defer func() {
+		db.observe(ctx, "write", start, err)
+		endSpan(span, err)
+	}()
+
+	if db.closed {
+		return ErrClosed
+	}
+	dbStructure.SchemaVersion = SchemaVersion
+	dat, err := json.Marshal(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	dbStruct.Revoked[tokenString] = t
-	return db.writeDB(dbStruct)
+	if _, err := f.Write(dat); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.path)
 }
 
-func (db *DB) IsTokenRevoked(tokenString string) bool {
-	dbStruct, err := db.loadDB()
+// Close waits for the writes in progress to finish and makes any later
+// write fail with ErrClosed. Reads keep working.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	db.closed = true
+	return nil
+}
+
+func (db *DB) RevokeToken(ctx context.Context, tokenString string) (err error) {
+	ctx, span := db.startSpan(ctx, "RevokeToken")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	t := time.Now().UnixMilli()
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		dbStruct.Revoked[tokenString] = t
+		return nil
+	})
+}
+
+// ConsumeToken revokes a single-use token. It returns ErrAlreadyUsed if the
+// token was revoked before, so of two requests racing with the same token
+// only one gets nil.
+func (db *DB) ConsumeToken(ctx context.Context, tokenString string) (err error) {
+	ctx, span := db.startSpan(ctx, "ConsumeToken")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	t := time.Now().UnixMilli()
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Revoked[tokenString]; ok {
+			return ErrAlreadyUsed
+		}
+		dbStruct.Revoked[tokenString] = t
+		return nil
+	})
+}
+
+func (db *DB) IsTokenRevoked(ctx context.Context, tokenString string) bool {
+	ctx, span := db.startSpan(ctx, "IsTokenRevoked")
+	dbStruct, err := db.loadDB(ctx)
+	endSpan(span, err)
 	if err != nil {
-		log.Println("Couldn't load DB: " + err.Error())
+		slog.ErrorContext(ctx, "Couldn't load the database", "err", err)
 		return true
 	}
 	_, ok := dbStruct.Revoked[tokenString]
 	return ok
 }
+
+// PurgeRevokedTokens forgets tokens revoked before before and returns how
+// many were removed. Only call it with a time past the longest token
+// lifetime, so the purged tokens have expired anyway.
+func (db *DB) PurgeRevokedTokens(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, span := db.startSpan(ctx, "PurgeRevokedTokens")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	purged := 0
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		for token, revokedAt := range dbStruct.Revoked {
+			if revokedAt < before.UnixMilli() {
+				delete(dbStruct.Revoked, token)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func (db *DB) GetLoginAttempt(ctx context.Context, key string) (_ LoginAttempt, err error) {
+	ctx, span := db.startSpan(ctx, "GetLoginAttempt")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+	attempt, ok := dbStruct.LoginAttempts[key]
+	if !ok {
+		return LoginAttempt{}, ErrNotExist
+	}
+	return attempt, nil
+}
+
+// UpdateLoginAttempt replaces the attempt of key with the result of fn,
+// which gets the stored attempt, or a zero one, in a single write. It returns
+// the stored result.
+func (db *DB) UpdateLoginAttempt(ctx context.Context, key string, fn func(attempt LoginAttempt) LoginAttempt) (_ LoginAttempt, err error) {
+	ctx, span := db.startSpan(ctx, "UpdateLoginAttempt")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	attempt := LoginAttempt{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		attempt = fn(dbStruct.LoginAttempts[key])
+		dbStruct.LoginAttempts[key] = attempt
+		return nil
+	})
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+	return attempt, nil
+}
+
+func (db *DB) GetLoginAttempts(ctx context.Context) (_ map[string]LoginAttempt, err error) {
+	ctx, span := db.startSpan(ctx, "GetLoginAttempts")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dbStruct.LoginAttempts, nil
+}
+
+// ClearLoginAttempts removes the lockout state for key. Clearing a key that
+// isn't tracked returns ErrNotExist.
+func (db *DB) ClearLoginAttempts(ctx context.Context, key string) (err error) {
+	ctx, span := db.startSpan(ctx, "ClearLoginAttempts")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.LoginAttempts[key]; !ok {
+			return ErrNotExist
+		}
+		delete(dbStruct.LoginAttempts, key)
+		return nil
+	})
+}
+
+// PurgeLoginAttempts removes the attempts whose last failure is older than
+// before and which aren't locked out anymore.
+func (db *DB) PurgeLoginAttempts(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, span := db.startSpan(ctx, "PurgeLoginAttempts")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	purged := 0
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		now := time.Now().UnixMilli()
+		for key, attempt := range dbStruct.LoginAttempts {
+			if attempt.LastFailure < before.UnixMilli() && attempt.LockedUntil < now {
+				delete(dbStruct.LoginAttempts, key)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// nextId allocates the id after the highest one ever handed out and records
+// it in last, so ids of deleted records aren't reused.
+func nextId[T any](records map[int]T, last *int) int {
+	id := *last
+	for existing := range records {
+		id = max(id, existing)
+	}
+	id++
+	*last = id
+	return id
+}
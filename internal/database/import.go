@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// ImportData is a batch of records added at once. Records refer to each
+// other by their position in the batch: the i-th user and the i-th chirp
+// have the id i+1 within it. Chirps refer to their author and the chirp they
+// reply to by those ids, and so do follows and likes. The stored records get
+// fresh ids.
+type ImportData struct {
+	Users  []User
+	Chirps []Chirp
+	// Follows maps a follower to the users they follow.
+	Follows map[int][]int
+	// Likes maps a chirp to the users who liked it.
+	Likes map[int][]int
+}
+
+// Import stores data in a single write. Nothing is stored if an email is
+// already taken or a record refers to one outside the batch. No events are
+// published.
+func (db *DB) Import(ctx context.Context, data ImportData) (err error) {
+	ctx, span := db.startSpan(ctx, "Import")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		emails := make(map[string]bool, len(dbStruct.Users)+len(data.Users))
+		for _, user := range dbStruct.Users {
+			emails[user.Email] = true
+		}
+
+		userIds := make([]int, len(data.Users))
+		for i, user := range data.Users {
+			if emails[user.Email] {
+				return fmt.Errorf("%w: %s", ErrAlreadyExists, user.Email)
+			}
+			emails[user.Email] = true
+			user.Id = nextId(dbStruct.Users, &dbStruct.LastUserId)
+			user.Version = max(user.Version, 1)
+			dbStruct.Users[user.Id] = user
+			userIds[i] = user.Id
+		}
+		userId := func(batchId int) (int, error) {
+			if batchId < 1 || batchId > len(userIds) {
+				return 0, fmt.Errorf("%w: user %d of the batch", ErrNotExist, batchId)
+			}
+			return userIds[batchId-1], nil
+		}
+
+		// Replies may refer to chirps later in the batch, so every chirp
+		// needs its id before replies are resolved.
+		chirpIds := make([]int, len(data.Chirps))
+		for i, chirp := range data.Chirps {
+			chirpIds[i] = nextId(dbStruct.Chirps, &dbStruct.LastChirpId)
+			dbStruct.Chirps[chirpIds[i]] = chirp
+		}
+		chirpId := func(batchId int) (int, error) {
+			if batchId < 1 || batchId > len(chirpIds) {
+				return 0, fmt.Errorf("%w: chirp %d of the batch", ErrNotExist, batchId)
+			}
+			return chirpIds[batchId-1], nil
+		}
+		for i, chirp := range data.Chirps {
+			var err error
+			chirp.Id = chirpIds[i]
+			chirp.Version = max(chirp.Version, 1)
+			if chirp.UserId, err = userId(chirp.UserId); err != nil {
+				return err
+			}
+			if chirp.ReplyTo != 0 {
+				if chirp.ReplyTo, err = chirpId(chirp.ReplyTo); err != nil {
+					return err
+				}
+			}
+			dbStruct.Chirps[chirp.Id] = chirp
+		}
+
+		for follower, followees := range data.Follows {
+			followerId, err := userId(follower)
+			if err != nil {
+				return err
+			}
+			for _, followee := range followees {
+				followeeId, err := userId(followee)
+				if err != nil {
+					return err
+				}
+				if !slices.Contains(dbStruct.Follows[followerId], followeeId) {
+					dbStruct.Follows[followerId] = append(dbStruct.Follows[followerId], followeeId)
+				}
+			}
+		}
+		for chirp, likers := range data.Likes {
+			likedId, err := chirpId(chirp)
+			if err != nil {
+				return err
+			}
+			for _, liker := range likers {
+				likerId, err := userId(liker)
+				if err != nil {
+					return err
+				}
+				if !slices.Contains(dbStruct.Likes[likedId], likerId) {
+					dbStruct.Likes[likedId] = append(dbStruct.Likes[likedId], likerId)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Reset deletes every record. Ids start over from 1.
+func (db *DB) Reset(ctx context.Context) (err error) {
+	ctx, span := db.startSpan(ctx, "Reset")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		*dbStruct = DBStructure{}
+		dbStruct.ensureMaps()
+		return nil
+	})
+}
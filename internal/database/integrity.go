@@ -0,0 +1,156 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+)
+
+// CheckIntegrity reads the file strictly and looks for the inconsistencies
+// hand edits leave behind. See CheckSnapshot.
+func (db *DB) CheckIntegrity(ctx context.Context) (_ []string, err error) {
+	ctx, span := db.startSpan(ctx, "CheckIntegrity")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	db.mux.RLock()
+	contents, err := os.ReadFile(db.path)
+	db.mux.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return CheckSnapshot(contents)
+}
+
+// CheckSnapshot looks for the inconsistencies hand edits leave behind in the
+// contents of a database file: unknown keys, records filed under the wrong
+// id, references to users, chirps or webhooks that don't exist, duplicate
+// emails and id counters behind the stored ids. It returns a description of
+// each problem, sorted. The error is only set when contents isn't valid JSON
+// at all.
+//
+// Replies and notifications may point at deleted chirps, that's expected.
+func CheckSnapshot(contents []byte) ([]string, error) {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Older versions are checked as they will be once migrated.
+	upgraded, _, err := upgrade(contents)
+	if errors.Is(err, ErrNewerSchema) {
+		add("%v", err)
+	} else if err == nil {
+		contents = upgraded
+	}
+
+	dbStruct := DBStructure{}
+	if err := json.Unmarshal(contents, &dbStruct); err != nil {
+		return nil, err
+	}
+	strict := json.NewDecoder(bytes.NewReader(contents))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(&DBStructure{}); err != nil {
+		add("%v", err)
+	}
+	dbStruct.ensureMaps()
+
+	checkIds(add, "user", dbStruct.Users, func(u User) int { return u.Id }, dbStruct.LastUserId)
+	checkIds(add, "chirp", dbStruct.Chirps, func(c Chirp) int { return c.Id }, dbStruct.LastChirpId)
+	checkIds(add, "notification", dbStruct.Notifications, func(n Notification) int { return n.Id }, dbStruct.LastNotifId)
+	checkIds(add, "webhook", dbStruct.Webhooks, func(w Webhook) int { return w.Id }, dbStruct.LastWebhookId)
+	checkIds(add, "webhook delivery", dbStruct.WebhookDeliveries, func(d WebhookDelivery) int { return d.Id }, dbStruct.LastDeliveryId)
+
+	emails := make(map[string]int)
+	for id, user := range dbStruct.Users {
+		if user.Email == "" {
+			add("user %d has no email", id)
+		} else if other, ok := emails[user.Email]; ok {
+			add("users %d and %d share the email %s", min(id, other), max(id, other), user.Email)
+		}
+		emails[user.Email] = id
+		if user.Password == "" {
+			add("user %d has no password hash", id)
+		}
+		if user.Version < 1 {
+			add("user %d has version %d", id, user.Version)
+		}
+	}
+	userExists := func(id int) bool {
+		_, ok := dbStruct.Users[id]
+		return ok
+	}
+
+	for id, chirp := range dbStruct.Chirps {
+		if !userExists(chirp.UserId) {
+			add("chirp %d is by user %d, who doesn't exist", id, chirp.UserId)
+		}
+		if chirp.Version < 1 {
+			add("chirp %d has version %d", id, chirp.Version)
+		}
+	}
+	for chirpId, likers := range dbStruct.Likes {
+		if _, ok := dbStruct.Chirps[chirpId]; !ok {
+			add("likes of chirp %d, which doesn't exist", chirpId)
+		}
+		for _, userId := range likers {
+			if !userExists(userId) {
+				add("chirp %d is liked by user %d, who doesn't exist", chirpId, userId)
+			}
+		}
+	}
+	for followerId, followees := range dbStruct.Follows {
+		if !userExists(followerId) {
+			add("follows of user %d, who doesn't exist", followerId)
+		}
+		for _, followeeId := range followees {
+			if !userExists(followeeId) {
+				add("user %d follows user %d, who doesn't exist", followerId, followeeId)
+			}
+		}
+	}
+	for id, notification := range dbStruct.Notifications {
+		if !userExists(notification.UserId) {
+			add("notification %d is for user %d, who doesn't exist", id, notification.UserId)
+		}
+		if !slices.Contains(NotificationTypes, notification.Type) {
+			add("notification %d has the unknown type %q", id, notification.Type)
+		}
+	}
+	for id, webhook := range dbStruct.Webhooks {
+		if !userExists(webhook.UserId) {
+			add("webhook %d belongs to user %d, who doesn't exist", id, webhook.UserId)
+		}
+	}
+	for id, delivery := range dbStruct.WebhookDeliveries {
+		if _, ok := dbStruct.Webhooks[delivery.WebhookId]; !ok {
+			add("webhook delivery %d is for webhook %d, which doesn't exist", id, delivery.WebhookId)
+		}
+		if !slices.Contains([]string{DeliveryPending, DeliveryDelivered, DeliveryDead}, delivery.Status) {
+			add("webhook delivery %d has the unknown status %q", id, delivery.Status)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// checkIds reports records filed under another id than their own, and a
+// last id counter behind the stored ids, which would let the ids of deleted
+// records be handed out again.
+func checkIds[T any](add func(format string, args ...interface{}), kind string, records map[int]T, id func(T) int, last int) {
+	for key, record := range records {
+		if id(record) != key {
+			add("%s %d is stored under the id %d", kind, id(record), key)
+		}
+		if key > last {
+			add("%s %d is past the last %s id %d", kind, key, kind, last)
+		}
+	}
+}
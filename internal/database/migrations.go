@@ -0,0 +1,220 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SchemaVersion is the version of the file format this code reads and
+// writes. Files written before it was recorded are version 0.
+const SchemaVersion = 4
+
+// ErrNewerSchema is returned for files written by a newer version of the
+// server. Reading them could silently drop what that version added.
+var ErrNewerSchema = errors.New("written by a newer version")
+
+// document is a database file with its top-level keys still undecoded, so
+// migrations can handle contents the current types can't describe.
+type document map[string]json.RawMessage
+
+// migration upgrades a document from version-1 to version.
+type migration struct {
+	version     int
+	description string
+	up          func(doc document) error
+}
+
+// migrations are run in order on files older than SchemaVersion. Append new
+// ones at the end with the next version and bump SchemaVersion, never edit
+// the ones already released.
+var migrations = []migration{
+	{1, "add the collections missing from files written before they were added", addMissingCollections},
+	{2, "start the versions of users and chirps written before versioning at 1", startRecordVersions},
+	{3, "move the id counters up to the highest stored id", backfillIdCounters},
+	{4, "replace the token revocation times of users with token generations", startTokenGenerations},
+}
+
+func addMissingCollections(doc document) error {
+	for _, key := range []string{"chirps", "users", "revoked", "login_attempts", "likes", "follows", "notifications", "webhooks", "webhook_deliveries"} {
+		if raw, ok := doc[key]; !ok || bytes.Equal(raw, []byte("null")) {
+			doc[key] = json.RawMessage("{}")
+		}
+	}
+	return nil
+}
+
+func startRecordVersions(doc document) error {
+	for _, key := range []string{"users", "chirps"} {
+		records := map[string]map[string]json.RawMessage{}
+		if err := json.Unmarshal(doc[key], &records); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		for _, record := range records {
+			if version, ok := record["version"]; !ok || bytes.Equal(version, []byte("0")) {
+				record["version"] = json.RawMessage("1")
+			}
+		}
+		dat, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		doc[key] = dat
+	}
+	return nil
+}
+
+// backfillIdCounters moves counters left behind their collection, in files
+// written before the counter existed or edited by hand. nextId skips the
+// stored ids anyway, but would reuse those of deleted records.
+func backfillIdCounters(doc document) error {
+	for _, c := range []struct{ collection, counter string }{
+		{"users", "last_user_id"},
+		{"chirps", "last_chirp_id"},
+		{"notifications", "last_notification_id"},
+		{"webhooks", "last_webhook_id"},
+		{"webhook_deliveries", "last_delivery_id"},
+	} {
+		records := map[int]json.RawMessage{}
+		if raw, ok := doc[c.collection]; ok {
+			if err := json.Unmarshal(raw, &records); err != nil {
+				return fmt.Errorf("%s: %w", c.collection, err)
+			}
+		}
+		last := 0
+		if raw, ok := doc[c.counter]; ok {
+			if err := json.Unmarshal(raw, &last); err != nil {
+				return fmt.Errorf("%s: %w", c.counter, err)
+			}
+		}
+		for id := range records {
+			last = max(last, id)
+		}
+		doc[c.counter] = json.RawMessage(fmt.Sprint(last))
+	}
+	return nil
+}
+
+// startTokenGenerations moves users whose tokens were revoked by time to
+// token generation 1. Tokens issued before then carry no generation, so
+// all of them are rejected, including those issued after the revocation:
+// those users have to log in again once.
+func startTokenGenerations(doc document) error {
+	records := map[string]map[string]json.RawMessage{}
+	if raw, ok := doc["users"]; ok {
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return fmt.Errorf("users: %w", err)
+		}
+	}
+	for _, record := range records {
+		if validAfter, ok := record["tokens_valid_after"]; ok && !bytes.Equal(validAfter, []byte("0")) {
+			record["token_generation"] = json.RawMessage("1")
+		}
+		delete(record, "tokens_valid_after")
+	}
+	dat, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	doc["users"] = dat
+	return nil
+}
+
+// schemaVersion returns the version contents were written with.
+func schemaVersion(contents []byte) (int, error) {
+	header := struct {
+		SchemaVersion int `json:"schema_version"`
+	}{}
+	if err := json.Unmarshal(contents, &header); err != nil {
+		return 0, err
+	}
+	return header.SchemaVersion, nil
+}
+
+// checkSchemaVersion refuses versions newer than SchemaVersion.
+func checkSchemaVersion(version int) error {
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: schema version %d, this version reads up to %d", ErrNewerSchema, version, SchemaVersion)
+	}
+	return nil
+}
+
+// upgrade runs the migrations contents needs and returns the result with
+// the version it started from. Contents at SchemaVersion are returned as
+// they are.
+func upgrade(contents []byte) ([]byte, int, error) {
+	from, err := schemaVersion(contents)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkSchemaVersion(from); err != nil {
+		return nil, from, err
+	}
+	if from == SchemaVersion {
+		return contents, from, nil
+	}
+
+	doc := document{}
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	if err := dec.Decode(&doc); err != nil {
+		return nil, from, err
+	}
+	if doc == nil {
+		return nil, from, errors.New("not a JSON object")
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, from, errors.New("data after the JSON object")
+	}
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		if err := m.up(doc); err != nil {
+			return nil, from, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	doc["schema_version"] = json.RawMessage(fmt.Sprint(SchemaVersion))
+	upgraded, err := json.Marshal(doc)
+	return upgraded, from, err
+}
+
+// migrate upgrades the file to SchemaVersion, after backing it up to
+// backupDir so a failed or unwanted migration can be undone. It runs before
+// the database is shared, in NewDB. Unknown keys are dropped, like every
+// write does.
+func (db *DB) migrate(backupDir string) error {
+	contents, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	upgraded, from, err := upgrade(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %w", db.path, err)
+	}
+	if from == SchemaVersion {
+		return nil
+	}
+	dbStruct := DBStructure{}
+	if err := json.Unmarshal(upgraded, &dbStruct); err != nil {
+		return fmt.Errorf("%s: %w", db.path, err)
+	}
+	dbStruct.ensureMaps()
+
+	ctx := context.Background()
+	backup, err := db.BackupToDir(ctx, backupDir, time.Now())
+	if err != nil {
+		return fmt.Errorf("couldn't back up %s before migrating it: %w", db.path, err)
+	}
+	if err := db.writeDB(ctx, dbStruct); err != nil {
+		return err
+	}
+	slog.Info("Migrated the database", "path", db.path, "from", from, "to", SchemaVersion, "backup", filepath.Join(backupDir, backup.Name))
+	return nil
+}
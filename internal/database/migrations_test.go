@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// baselineFile is a database written before the format was versioned, with
+// only chirps, users and revoked tokens and no id counters.
+const baselineFile = `{"chirps":{"1":{"id":1,"body":"hello","author_id":2},"4":{"id":4,"body":"again","author_id":2}},"users":{"2":{"id":2,"email":"jo@example.com","password":"hash","is_chirpy_red":false}},"revoked":{"token":1700000000000}}`
+
+func writeTestFile(t *testing.T, contents string) (path string, backupDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	path = filepath.Join(dir, "database.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, filepath.Join(dir, "backups")
+}
+
+func TestNewDBMigratesBaselineFile(t *testing.T) {
+	path, backupDir := writeTestFile(t, baselineFile)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	dbStruct, err := db.loadDB(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbStruct.SchemaVersion != SchemaVersion {
+		t.Errorf("schema version = %d, want %d", dbStruct.SchemaVersion, SchemaVersion)
+	}
+	if dbStruct.Likes == nil || dbStruct.Webhooks == nil || dbStruct.WebhookDeliveries == nil {
+		t.Error("collections added after the baseline are missing")
+	}
+	if user := dbStruct.Users[2]; user.Email != "jo@example.com" || user.Version != 1 {
+		t.Errorf("user = %+v, want jo@example.com at version 1", user)
+	}
+	for id, chirp := range dbStruct.Chirps {
+		if chirp.Version != 1 {
+			t.Errorf("chirp %d is at version %d, want 1", id, chirp.Version)
+		}
+	}
+	if _, ok := dbStruct.Revoked["token"]; !ok {
+		t.Error("the revoked token was dropped")
+	}
+	if dbStruct.LastUserId != 2 || dbStruct.LastChirpId != 4 {
+		t.Errorf("id counters = %d users, %d chirps, want 2 and 4", dbStruct.LastUserId, dbStruct.LastChirpId)
+	}
+
+	// New records get ids past the stored ones.
+	chirp, err := db.CreateChirp(context.Background(), "new", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 5 {
+		t.Errorf("new chirp id = %d, want 5", chirp.Id)
+	}
+}
+
+func TestNewDBBacksUpBeforeMigrating(t *testing.T) {
+	path, backupDir := writeTestFile(t, baselineFile)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+
+	backups, err := db.Backups(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	contents, err := os.ReadFile(filepath.Join(backupDir, backups[0].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != baselineFile {
+		t.Errorf("backup = %s, want the file as it was before the migration", contents)
+	}
+	if info, err := os.Stat(backupDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("backup dir = %v, %v, want mode 0700", info, err)
+	}
+
+	// Opening the migrated file again doesn't back it up again.
+	db.Close()
+	db, err = NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	if backups, _ := db.Backups(backupDir); len(backups) != 1 {
+		t.Errorf("got %d backups after reopening, want 1", len(backups))
+	}
+}
+
+func TestNewDBRefusesNewerSchema(t *testing.T) {
+	newer := fmt.Sprintf(`{"schema_version":%d,"chirps":{},"users":{}}`, SchemaVersion+1)
+	path, backupDir := writeTestFile(t, newer)
+	if _, err := NewDB(path, backupDir); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("NewDB = %v, want %v", err, ErrNewerSchema)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != newer {
+		t.Errorf("the file was changed to %s", contents)
+	}
+	if _, err := os.Stat(backupDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a backup was taken of a file that wasn't migrated")
+	}
+}
+
+func TestReadFileRefusesNewerSchema(t *testing.T) {
+	path, backupDir := writeTestFile(t, baselineFile)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	// A newer version replaces the file while this one is running.
+	newer := fmt.Sprintf(`{"schema_version":%d,"chirps":{},"users":{}}`, SchemaVersion+1)
+	if err := os.WriteFile(path, []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(context.Background()); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("Ping = %v, want %v", err, ErrNewerSchema)
+	}
+	if _, err := db.CreateUser(context.Background(), "new@example.com", "hash"); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("CreateUser = %v, want %v", err, ErrNewerSchema)
+	}
+}
+
+func TestRestoreRefusesNewerSchema(t *testing.T) {
+	path, backupDir := writeTestFile(t, baselineFile)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer := fmt.Sprintf(`{"schema_version":%d,"chirps":{},"users":{}}`, SchemaVersion+1)
+	if err := db.Restore(context.Background(), []byte(newer)); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("Restore = %v, want %v", err, ErrNewerSchema)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("the refused snapshot changed the database")
+	}
+}
+
+func TestRestoreMigratesOlderSnapshots(t *testing.T) {
+	path, backupDir := writeTestFile(t, `{}`)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Restore(context.Background(), []byte(baselineFile)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	user, err := db.FindUserById(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != 1 {
+		t.Errorf("user version = %d, want 1", user.Version)
+	}
+}
+
+func TestNewDBStartsTokenGenerations(t *testing.T) {
+	v3 := `{"schema_version":3,"users":{"1":{"id":1,"email":"jo@example.com","version":1,"tokens_valid_after":1700000000000},"2":{"id":2,"email":"sam@example.com","version":1}}}`
+	path, backupDir := writeTestFile(t, v3)
+	db, err := NewDB(path, backupDir)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	for id, want := range map[int]int{1: 1, 2: 0} {
+		user, err := db.FindUserById(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.TokenGeneration != want {
+			t.Errorf("user %d is at token generation %d, want %d", id, user.TokenGeneration, want)
+		}
+	}
+}
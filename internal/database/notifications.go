@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+const (
+	NotificationFollow  = "follow"
+	NotificationMention = "mention"
+	NotificationReply   = "reply"
+	NotificationLike    = "like"
+)
+
+var NotificationTypes = []string{NotificationFollow, NotificationMention, NotificationReply, NotificationLike}
+
+// Notification tells UserId that ActorId interacted with them. ChirpId is
+// the chirp involved, if any. CreatedAt is in unix milliseconds.
+type Notification struct {
+	Id        int    `json:"id"`
+	UserId    int    `json:"user_id"`
+	Type      string `json:"type"`
+	ActorId   int    `json:"actor_id"`
+	ChirpId   int    `json:"chirp_id,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Read      bool   `json:"read"`
+}
+
+// CreateNotification stores a notification unless the recipient turned its
+// type off, in which case it returns false.
+func (db *DB) CreateNotification(ctx context.Context, userId int, notificationType string, actorId int, chirpId int) (_ Notification, _ bool, err error) {
+	ctx, span := db.startSpan(ctx, "CreateNotification")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	notification := Notification{}
+	created := false
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users[userId]
+		if !ok {
+			return ErrNotExist
+		}
+		if enabled, ok := user.NotificationPrefs[notificationType]; ok && !enabled {
+			return nil
+		}
+		notification = Notification{
+			Id:        nextId(dbStruct.Notifications, &dbStruct.LastNotifId),
+			UserId:    userId,
+			Type:      notificationType,
+			ActorId:   actorId,
+			ChirpId:   chirpId,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+		dbStruct.Notifications[notification.Id] = notification
+		created = true
+		return nil
+	})
+	if err != nil {
+		return Notification{}, false, err
+	}
+	if created {
+		db.events.Publish(EventNotification, notification)
+	}
+	return notification, created, nil
+}
+
+// GetNotifications returns a page of the user's notifications, newest
+// first, and how many of all their notifications are unread. The page holds
+// up to limit notifications with ids below before, or the newest ones if
+// before is 0.
+func (db *DB) GetNotifications(ctx context.Context, userId int, unreadOnly bool, before int, limit int) (_ []Notification, _ int, err error) {
+	ctx, span := db.startSpan(ctx, "GetNotifications")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	notifications := []Notification{}
+	unread := 0
+	for _, notification := range dbStruct.Notifications {
+		if notification.UserId != userId {
+			continue
+		}
+		if !notification.Read {
+			unread++
+		}
+		if (unreadOnly && notification.Read) || (before > 0 && notification.Id >= before) {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	slices.SortFunc(notifications, func(a, b Notification) int {
+		return b.Id - a.Id
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+	return notifications, unread, nil
+}
+
+// MarkNotificationsRead marks the given notifications of the user as read,
+// or all of them if ids is empty.
+func (db *DB) MarkNotificationsRead(ctx context.Context, userId int, ids []int) (err error) {
+	ctx, span := db.startSpan(ctx, "MarkNotificationsRead")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		for id, notification := range dbStruct.Notifications {
+			if notification.UserId != userId || (len(ids) > 0 && !slices.Contains(ids, id)) {
+				continue
+			}
+			notification.Read = true
+			dbStruct.Notifications[id] = notification
+		}
+		return nil
+	})
+}
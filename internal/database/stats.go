@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Stats summarizes the database for the admin dashboard.
+type Stats struct {
+	Users          int
+	VerifiedUsers  int
+	ChirpyRedUsers int
+	Chirps         int
+	RevokedTokens  int
+	// SignupsPerDay and ChirpsPerDay count the records created on each UTC
+	// day of the requested range, oldest first. Records created before
+	// timestamps were recorded aren't counted.
+	SignupsPerDay []DayCount
+	ChirpsPerDay  []DayCount
+	// TopAuthors are the users with the most chirps, most first.
+	TopAuthors []AuthorCount
+}
+
+type DayCount struct {
+	Day   time.Time
+	Count int
+}
+
+type AuthorCount struct {
+	UserId int
+	Email  string
+	Chirps int
+}
+
+// Stats counts the stored records. The per-day counts cover the last days
+// UTC days, today included, and at most topAuthors authors are listed.
+func (db *DB) Stats(ctx context.Context, now time.Time, days int, topAuthors int) (_ Stats, err error) {
+	ctx, span := db.startSpan(ctx, "Stats")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, 1-days)
+	perDay := func() []DayCount {
+		counts := make([]DayCount, days)
+		for i := range counts {
+			counts[i].Day = first.AddDate(0, 0, i)
+		}
+		return counts
+	}
+	// countDay adds a record created at createdAt to its day, if it's in
+	// the range.
+	countDay := func(counts []DayCount, createdAt int64) {
+		if createdAt == 0 {
+			return
+		}
+		day := int(time.UnixMilli(createdAt).UTC().Sub(first) / (24 * time.Hour))
+		if createdAt >= first.UnixMilli() && day < days {
+			counts[day].Count++
+		}
+	}
+
+	stats := Stats{
+		Users:         len(dbStruct.Users),
+		Chirps:        len(dbStruct.Chirps),
+		RevokedTokens: len(dbStruct.Revoked),
+		SignupsPerDay: perDay(),
+		ChirpsPerDay:  perDay(),
+	}
+	for _, user := range dbStruct.Users {
+		if user.EmailVerified {
+			stats.VerifiedUsers++
+		}
+		if user.ChirpyRed {
+			stats.ChirpyRedUsers++
+		}
+		countDay(stats.SignupsPerDay, user.CreatedAt)
+	}
+
+	chirpsByAuthor := make(map[int]int)
+	for _, chirp := range dbStruct.Chirps {
+		chirpsByAuthor[chirp.UserId]++
+		countDay(stats.ChirpsPerDay, chirp.CreatedAt)
+	}
+	for userId, chirps := range chirpsByAuthor {
+		stats.TopAuthors = append(stats.TopAuthors, AuthorCount{
+			UserId: userId,
+			Email:  dbStruct.Users[userId].Email,
+			Chirps: chirps,
+		})
+	}
+	slices.SortFunc(stats.TopAuthors, func(a, b AuthorCount) int {
+		if a.Chirps != b.Chirps {
+			return b.Chirps - a.Chirps
+		}
+		return a.UserId - b.UserId
+	})
+	if len(stats.TopAuthors) > topAuthors {
+		stats.TopAuthors = stats.TopAuthors[:topAuthors]
+	}
+	return stats, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package database
+
+// syncDir is a no-op where directories can't be synced.
+func syncDir(dir string) error {
+	return nil
+}
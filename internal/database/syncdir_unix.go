@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package database
+
+import "os"
+
+// syncDir makes a new name in dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer reports to the global tracer provider, so spans are dropped until
+// the server installs one.
+var tracer = otel.Tracer("github.com/petomackay/chirpy/internal/database")
+
+// startSpan starts the span of a DB method. Its children are the file reads
+// and writes, which tell the time spent on I/O from the time spent waiting
+// for the lock.
+func (db *DB) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "DB."+method, trace.WithAttributes(
+		attribute.String("db.system", "jsonfile"),
+		attribute.String("db.operation.name", method),
+	))
+}
+
+// startFileSpan starts the span of a read or a write of the database file.
+func (db *DB) startFileSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db.file."+op, trace.WithAttributes(
+		attribute.String("db.system", "jsonfile"),
+		attribute.String("file.path", db.path),
+	))
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
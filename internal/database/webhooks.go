@@ -0,0 +1,287 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead deliveries ran out of retries. They're kept as a dead
+	// letter list until retried by hand.
+	DeliveryDead = "dead"
+)
+
+type Webhook struct {
+	Id        int      `json:"id"`
+	UserId    int      `json:"user_id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret"`
+	Events    []string `json:"events"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// WebhookDelivery is one event to be sent to one webhook. Timestamps are
+// unix milliseconds.
+type WebhookDelivery struct {
+	Id             int    `json:"id"`
+	WebhookId      int    `json:"webhook_id"`
+	Event          string `json:"event"`
+	Payload        string `json:"payload"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  int64  `json:"next_attempt_at"`
+	LastStatusCode int    `json:"last_status_code,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	DeliveredAt    int64  `json:"delivered_at,omitempty"`
+}
+
+func (db *DB) CreateWebhook(ctx context.Context, userId int, url string, secret string, events []string) (_ Webhook, err error) {
+	ctx, span := db.startSpan(ctx, "CreateWebhook")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	webhook := Webhook{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		webhook = Webhook{
+			Id:        nextId(dbStruct.Webhooks, &dbStruct.LastWebhookId),
+			UserId:    userId,
+			URL:       url,
+			Secret:    secret,
+			Events:    events,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+		dbStruct.Webhooks[webhook.Id] = webhook
+		return nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+// GetWebhook returns the webhook only if it belongs to userId.
+func (db *DB) GetWebhook(ctx context.Context, id int, userId int) (_ Webhook, err error) {
+	ctx, span := db.startSpan(ctx, "GetWebhook")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook, ok := dbStruct.Webhooks[id]
+	if !ok || webhook.UserId != userId {
+		return Webhook{}, ErrNotExist
+	}
+	return webhook, nil
+}
+
+func (db *DB) GetWebhooks(ctx context.Context, userId int) (_ []Webhook, err error) {
+	ctx, span := db.startSpan(ctx, "GetWebhooks")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := []Webhook{}
+	for _, webhook := range dbStruct.Webhooks {
+		if webhook.UserId == userId {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	slices.SortFunc(webhooks, func(a, b Webhook) int {
+		return a.Id - b.Id
+	})
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the user's webhook along with its deliveries.
+func (db *DB) DeleteWebhook(ctx context.Context, id int, userId int) (err error) {
+	ctx, span := db.startSpan(ctx, "DeleteWebhook")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		webhook, ok := dbStruct.Webhooks[id]
+		if !ok || webhook.UserId != userId {
+			return ErrNotExist
+		}
+		delete(dbStruct.Webhooks, id)
+		for deliveryId, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.WebhookId == id {
+				delete(dbStruct.WebhookDeliveries, deliveryId)
+			}
+		}
+		return nil
+	})
+}
+
+// EnqueueWebhookDeliveries records a delivery of payload for every webhook
+// of userId subscribed to event and returns them.
+func (db *DB) EnqueueWebhookDeliveries(ctx context.Context, userId int, event string, payload string) (_ []WebhookDelivery, err error) {
+	ctx, span := db.startSpan(ctx, "EnqueueWebhookDeliveries")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	deliveries := []WebhookDelivery{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		now := time.Now().UnixMilli()
+		for _, webhook := range dbStruct.Webhooks {
+			if webhook.UserId != userId || !slices.Contains(webhook.Events, event) {
+				continue
+			}
+			delivery := WebhookDelivery{
+				Id:            nextId(dbStruct.WebhookDeliveries, &dbStruct.LastDeliveryId),
+				WebhookId:     webhook.Id,
+				Event:         event,
+				Payload:       payload,
+				Status:        DeliveryPending,
+				NextAttemptAt: now,
+				CreatedAt:     now,
+			}
+			dbStruct.WebhookDeliveries[delivery.Id] = delivery
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (db *DB) GetWebhookDelivery(ctx context.Context, id int) (_ WebhookDelivery, err error) {
+	ctx, span := db.startSpan(ctx, "GetWebhookDelivery")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery, ok := dbStruct.WebhookDeliveries[id]
+	if !ok {
+		return WebhookDelivery{}, ErrNotExist
+	}
+	return delivery, nil
+}
+
+func (db *DB) GetWebhookById(ctx context.Context, id int) (_ Webhook, err error) {
+	ctx, span := db.startSpan(ctx, "GetWebhookById")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook, ok := dbStruct.Webhooks[id]
+	if !ok {
+		return Webhook{}, ErrNotExist
+	}
+	return webhook, nil
+}
+
+func (db *DB) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) (err error) {
+	ctx, span := db.startSpan(ctx, "UpdateWebhookDelivery")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return db.update(ctx, func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.WebhookDeliveries[delivery.Id]; !ok {
+			return ErrNotExist
+		}
+		dbStruct.WebhookDeliveries[delivery.Id] = delivery
+		return nil
+	})
+}
+
+// GetWebhookDeliveries returns the deliveries of a webhook, newest first,
+// optionally only those with the given status.
+func (db *DB) GetWebhookDeliveries(ctx context.Context, webhookId int, status string) (_ []WebhookDelivery, err error) {
+	ctx, span := db.startSpan(ctx, "GetWebhookDeliveries")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	dbStruct, err := db.loadDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range dbStruct.WebhookDeliveries {
+		if delivery.WebhookId == webhookId && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	slices.SortFunc(deliveries, func(a, b WebhookDelivery) int {
+		return b.Id - a.Id
+	})
+	return deliveries, nil
+}
+
+// RetryWebhookDelivery marks a dead delivery pending again. The caller
+// queues the job sending it.
+func (db *DB) RetryWebhookDelivery(ctx context.Context, id int, webhookId int) (_ WebhookDelivery, err error) {
+	ctx, span := db.startSpan(ctx, "RetryWebhookDelivery")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	delivery := WebhookDelivery{}
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		stored, ok := dbStruct.WebhookDeliveries[id]
+		if !ok || stored.WebhookId != webhookId {
+			return ErrNotExist
+		}
+		if stored.Status != DeliveryDead {
+			return ErrAlreadyExists
+		}
+		stored.Status = DeliveryPending
+		stored.Attempts = 0
+		stored.NextAttemptAt = time.Now().UnixMilli()
+		dbStruct.WebhookDeliveries[id] = stored
+		delivery = stored
+		return nil
+	})
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return delivery, nil
+}
+
+// PurgeWebhookDeliveries removes delivered deliveries older than before and
+// returns how many were removed. Dead ones are kept until retried or their
+// webhook is deleted.
+func (db *DB) PurgeWebhookDeliveries(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, span := db.startSpan(ctx, "PurgeWebhookDeliveries")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	purged := 0
+	err = db.update(ctx, func(dbStruct *DBStructure) error {
+		for id, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.Status == DeliveryDelivered && delivery.DeliveredAt < before.UnixMilli() {
+				delete(dbStruct.WebhookDeliveries, id)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
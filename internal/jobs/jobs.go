@@ -0,0 +1,461 @@
+// Package jobs runs work outside of request handlers. Jobs are persisted to
+// a JSON file, retried with backoff when they fail and can be scheduled with
+// cron expressions.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	// StatusDone jobs are removed from the store, the status is only seen
+	// by the queue itself.
+	StatusDone = "done"
+	// StatusDead jobs ran out of attempts. They're kept for inspection.
+	StatusDead = "dead"
+
+	defaultMaxAttempts  = 5
+	defaultPollInterval = time.Second
+)
+
+// Job is a unit of work of a registered kind. Timestamps are unix
+// milliseconds.
+type Job struct {
+	Id          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       int64           `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   int64           `json:"created_at"`
+}
+
+// LastAttempt reports whether a failure of the current attempt makes the job
+// dead.
+func (j Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+// Decode unmarshals the payload into v.
+func (j Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Handler runs a job. Returning an error retries the job after a backoff,
+// unless it's wrapped with Permanent or the job ran out of attempts. ctx is
+// cancelled when the queue stops waiting for running jobs during shutdown.
+type Handler func(ctx context.Context, job Job) error
+
+type Options struct {
+	// Concurrency is the number of workers running jobs of the kind.
+	// Defaults to 1.
+	Concurrency int
+	// MaxAttempts defaults to 5.
+	MaxAttempts int
+	// Backoff returns the wait before the next attempt after attempt
+	// failed. Defaults to ExponentialBackoff(time.Second, time.Hour).
+	Backoff func(attempt int) time.Duration
+	// Timeout limits a single attempt. Zero means no limit.
+	Timeout time.Duration
+	// Interrupted is called by Start for each job of the kind that died
+	// because the process crashed during its last attempt, so the handler
+	// never saw it fail. Handlers that track their own state use it to mark
+	// that dead too. It runs before the workers start and must not use the
+	// queue.
+	Interrupted func(ctx context.Context, job Job)
+}
+
+var ErrUnknownKind = errors.New("unknown job kind")
+var ErrStopped = errors.New("job queue is shutting down")
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying won't fix, the job is moved
+// straight to the dead jobs.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// ExponentialBackoff doubles the wait after every attempt, starting at base
+// and capped at max.
+func ExponentialBackoff(base time.Duration, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		backoff := base
+		for i := 1; i < attempt; i++ {
+			backoff *= 2
+			if backoff >= max {
+				return max
+			}
+		}
+		return backoff
+	}
+}
+
+type registration struct {
+	handler Handler
+	opts    Options
+	// wake is poked when a job of the kind is enqueued so idle workers
+	// don't wait for the next poll.
+	wake chan struct{}
+}
+
+type scheduled struct {
+	schedule Schedule
+	kind     string
+	payload  json.RawMessage
+	next     time.Time
+}
+
+type Queue struct {
+	store        *store
+	mux          *sync.Mutex
+	kinds        map[string]*registration
+	schedules    []*scheduled
+	pollInterval time.Duration
+
+	started bool
+	// stop is closed when shutdown starts. Workers finish their current
+	// job and exit.
+	stop chan struct{}
+	// runCtx is passed to handlers and cancelled when the drain deadline
+	// passes.
+	runCtx    context.Context
+	cancelRun context.CancelFunc
+	wg        *sync.WaitGroup
+}
+
+// Open loads the queue stored at path, creating the file if needed. Jobs
+// interrupted by a crash are queued again, unless it was their last attempt.
+func Open(path string) (*Queue, error) {
+	s, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	return &Queue{
+		store:        s,
+		mux:          &sync.Mutex{},
+		kinds:        make(map[string]*registration),
+		pollInterval: defaultPollInterval,
+		stop:         make(chan struct{}),
+		runCtx:       runCtx,
+		cancelRun:    cancelRun,
+		wg:           &sync.WaitGroup{},
+	}, nil
+}
+
+// Register sets the handler of kind. It must be called before Start.
+func (q *Queue) Register(kind string, handler Handler, opts Options) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = ExponentialBackoff(time.Second, time.Hour)
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.kinds[kind] = &registration{
+		handler: handler,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Schedule enqueues a job of kind every time the cron spec matches. A run is
+// skipped while the previous job of the kind is still waiting or running.
+func (q *Queue) Schedule(spec string, kind string, payload interface{}) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if _, ok := q.kinds[kind]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	q.schedules = append(q.schedules, &scheduled{
+		schedule: schedule,
+		kind:     kind,
+		payload:  dat,
+	})
+	return nil
+}
+
+// Enqueue queues a job of kind to run as soon as a worker is free.
+func (q *Queue) Enqueue(kind string, payload interface{}) (Job, error) {
+	return q.EnqueueAt(kind, payload, time.Now())
+}
+
+// EnqueueAt queues a job of kind to run at runAt or later.
+func (q *Queue) EnqueueAt(kind string, payload interface{}, runAt time.Time) (Job, error) {
+	q.mux.Lock()
+	reg, ok := q.kinds[kind]
+	q.mux.Unlock()
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrUnknownKind, kind)
+	}
+	select {
+	case <-q.stop:
+		return Job{}, ErrStopped
+	default:
+	}
+
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	job, err := q.store.add(Job{
+		Kind:        kind,
+		Payload:     dat,
+		Status:      StatusQueued,
+		MaxAttempts: reg.opts.MaxAttempts,
+		RunAt:       runAt.UnixMilli(),
+		CreatedAt:   time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	select {
+	case reg.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Jobs lists the stored jobs with the given status, or all of them when
+// status is empty.
+func (q *Queue) Jobs(status string) []Job {
+	return q.store.list(status)
+}
+
+// PurgeDead removes the dead jobs whose last attempt was due before before
+// and returns how many were removed.
+func (q *Queue) PurgeDead(before time.Time) (int, error) {
+	return q.store.purgeDead(before)
+}
+
+// Stats is a snapshot of the queue for health checks.
+type Stats struct {
+	// Started is true while the workers are running.
+	Started bool
+	Queued  int
+	Running int
+	Dead    int
+	// Lag is how long the oldest due job has been waiting to run. It grows
+	// when the workers are stuck or can't keep up.
+	Lag time.Duration
+	// SaveErr is the error of the last write to the queue file, if it
+	// failed.
+	SaveErr error
+}
+
+// Stats counts the stored jobs and reports whether the workers are running.
+func (q *Queue) Stats() Stats {
+	stats := q.store.stats(time.Now())
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	select {
+	case <-q.stop:
+	default:
+		stats.Started = q.started
+	}
+	return stats
+}
+
+// Start launches the workers and the scheduler.
+func (q *Queue) Start() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.started {
+		return
+	}
+	q.started = true
+
+	for _, job := range q.store.takeInterrupted() {
+		if reg, ok := q.kinds[job.Kind]; ok && reg.opts.Interrupted != nil {
+			reg.opts.Interrupted(q.runCtx, job)
+		}
+	}
+	for kind, reg := range q.kinds {
+		for i := 0; i < reg.opts.Concurrency; i++ {
+			q.wg.Add(1)
+			go q.work(kind, reg)
+		}
+	}
+	if len(q.schedules) > 0 {
+		q.wg.Add(1)
+		go q.runScheduler()
+	}
+}
+
+// Shutdown stops taking new jobs and waits for the running ones to finish.
+// When ctx is done first, the running jobs' contexts are cancelled and they
+// are queued again without counting the attempt.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mux.Lock()
+	select {
+	case <-q.stop:
+	default:
+		close(q.stop)
+	}
+	q.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancelRun()
+		return nil
+	case <-ctx.Done():
+		q.cancelRun()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work(kind string, reg *registration) {
+	defer q.wg.Done()
+
+	timer := time.NewTimer(q.pollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		job, ok, err := q.store.claim(kind, time.Now())
+		if err != nil {
+			slog.Error("Couldn't claim a job", "kind", kind, "err", err)
+		}
+		if ok {
+			q.run(reg, job)
+			continue
+		}
+
+		timer.Reset(q.pollInterval)
+		select {
+		case <-q.stop:
+			return
+		case <-reg.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+func (q *Queue) run(reg *registration, job Job) {
+	ctx := q.runCtx
+	if reg.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reg.opts.Timeout)
+		defer cancel()
+	}
+
+	err := runHandler(ctx, reg.handler, job)
+	switch {
+	case err == nil:
+		job.Status = StatusDone
+	case q.runCtx.Err() != nil:
+		// Interrupted by shutdown, it's not the job's fault.
+		job.Status = StatusQueued
+		job.Attempts--
+	case job.LastAttempt() || errors.As(err, &permanentError{}):
+		slog.Error("Job failed for good", "job_id", job.Id, "kind", job.Kind, "attempts", job.Attempts, "err", err)
+		job.Status = StatusDead
+		job.LastError = err.Error()
+	default:
+		slog.Warn("Job failed, retrying", "job_id", job.Id, "kind", job.Kind, "attempts", job.Attempts, "err", err)
+		job.Status = StatusQueued
+		job.LastError = err.Error()
+		job.RunAt = time.Now().Add(reg.opts.Backoff(job.Attempts)).UnixMilli()
+	}
+
+	if err := q.store.put(job); err != nil {
+		slog.Error("Couldn't save job", "job_id", job.Id, "kind", job.Kind, "err", err)
+	}
+}
+
+// runHandler turns a panic into an error, so one bad job can't take the
+// server down.
+func runHandler(ctx context.Context, handler Handler, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func (q *Queue) runScheduler() {
+	defer q.wg.Done()
+
+	now := time.Now()
+	for _, s := range q.schedules {
+		s.next = s.schedule.Next(now)
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		next := time.Time{}
+		for _, s := range q.schedules {
+			if !s.next.IsZero() && (next.IsZero() || s.next.Before(next)) {
+				next = s.next
+			}
+		}
+		if next.IsZero() {
+			return
+		}
+
+		timer.Reset(time.Until(next))
+		select {
+		case <-q.stop:
+			return
+		case now = <-timer.C:
+		}
+
+		for _, s := range q.schedules {
+			if s.next.After(now) {
+				continue
+			}
+			s.next = s.schedule.Next(now)
+			if q.store.pending(s.kind) {
+				continue
+			}
+			if _, err := q.EnqueueAt(s.kind, s.payload, now); err != nil {
+				slog.Error("Couldn't enqueue scheduled job", "kind", s.kind, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// store keeps the jobs in memory and writes every change through to a JSON
+// file, so queued jobs survive a restart.
+type store struct {
+	path string
+	mux  *sync.Mutex
+	data storeFile
+	// saveErr is the result of the last save.
+	saveErr error
+	// interrupted are the jobs openStore found running on their last
+	// attempt, which died in a crash. Start reports them.
+	interrupted []Job
+}
+
+type storeFile struct {
+	Jobs   map[int]Job `json:"jobs"`
+	LastId int         `json:"last_id"`
+}
+
+func openStore(path string) (*store, error) {
+	s := store{
+		path: path,
+		mux:  &sync.Mutex{},
+		data: storeFile{Jobs: make(map[int]Job)},
+	}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &s, s.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &s.data); err != nil {
+		return nil, err
+	}
+	if s.data.Jobs == nil {
+		s.data.Jobs = make(map[int]Job)
+	}
+
+	// Jobs still marked running were interrupted by a crash. Their attempt
+	// is counted, so a job that crashes the process can't loop forever: it
+	// dies once the crash was its last attempt.
+	for id, job := range s.data.Jobs {
+		if job.Status != StatusRunning {
+			continue
+		}
+		if job.LastAttempt() {
+			job.Status = StatusDead
+			job.LastError = "interrupted by a crash"
+			s.interrupted = append(s.interrupted, job)
+		} else {
+			job.Status = StatusQueued
+		}
+		s.data.Jobs[id] = job
+	}
+	return &s, s.save()
+}
+
+// save writes the jobs through to the file. Callers hold the lock.
+func (s *store) save() error {
+	s.saveErr = s.write()
+	return s.saveErr
+}
+
+// write goes through a synced temporary file first, so a crash mid-write
+// can't leave a truncated queue behind, and syncs the directory, so a
+// claimed attempt is on disk before the job runs.
+func (s *store) write() error {
+	dat, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(dat); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+func (s *store) add(job Job) (Job, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.data.LastId++
+	job.Id = s.data.LastId
+	s.data.Jobs[job.Id] = job
+	if err := s.save(); err != nil {
+		delete(s.data.Jobs, job.Id)
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// claim marks the oldest due job of kind as running and counts the attempt.
+func (s *store) claim(kind string, now time.Time) (Job, bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	found := false
+	next := Job{}
+	for _, job := range s.data.Jobs {
+		if job.Kind != kind || job.Status != StatusQueued || job.RunAt > now.UnixMilli() {
+			continue
+		}
+		if !found || job.RunAt < next.RunAt || (job.RunAt == next.RunAt && job.Id < next.Id) {
+			next = job
+			found = true
+		}
+	}
+	if !found {
+		return Job{}, false, nil
+	}
+
+	previous := next
+	next.Status = StatusRunning
+	next.Attempts++
+	s.data.Jobs[next.Id] = next
+	if err := s.save(); err != nil {
+		s.data.Jobs[next.Id] = previous
+		return Job{}, false, err
+	}
+	return next, true, nil
+}
+
+// put replaces a job, or removes it when it's done.
+func (s *store) put(job Job) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if job.Status == StatusDone {
+		delete(s.data.Jobs, job.Id)
+	} else {
+		s.data.Jobs[job.Id] = job
+	}
+	return s.save()
+}
+
+// purgeDead removes the dead jobs whose last attempt was due before before.
+func (s *store) purgeDead(before time.Time) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	purged := 0
+	for id, job := range s.data.Jobs {
+		if job.Status == StatusDead && job.RunAt < before.UnixMilli() {
+			delete(s.data.Jobs, id)
+			purged++
+		}
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	return purged, s.save()
+}
+
+// pending reports whether a job of kind is waiting or running.
+func (s *store) pending(kind string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, job := range s.data.Jobs {
+		if job.Kind == kind && (job.Status == StatusQueued || job.Status == StatusRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeInterrupted returns the jobs that died in a crash, once.
+func (s *store) takeInterrupted() []Job {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	interrupted := s.interrupted
+	s.interrupted = nil
+	return interrupted
+}
+
+func (s *store) list(status string) []Job {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	jobs := []Job{}
+	for _, job := range s.data.Jobs {
+		if status == "" || job.Status == status {
+			jobs = append(jobs, job)
+		}
+	}
+	slices.SortFunc(jobs, func(a, b Job) int {
+		return a.Id - b.Id
+	})
+	return jobs
+}
+
+// stats counts the jobs by status and finds the queued job that has been
+// due the longest.
+func (s *store) stats(now time.Time) Stats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := Stats{SaveErr: s.saveErr}
+	for _, job := range s.data.Jobs {
+		switch job.Status {
+		case StatusQueued:
+			stats.Queued++
+			if lag := now.Sub(time.UnixMilli(job.RunAt)); lag > stats.Lag {
+				stats.Lag = lag
+			}
+		case StatusRunning:
+			stats.Running++
+		case StatusDead:
+			stats.Dead++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,114 @@
+package jobs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenStoreRecoversRunningJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, maxAttempts := range []int{1, 3} {
+		if _, err := s.add(Job{Kind: "test", Status: StatusQueued, MaxAttempts: maxAttempts, RunAt: now.UnixMilli()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both jobs are running when the process crashes: the first one on its
+	// only attempt, the second on its first of three.
+	for i := 0; i < 2; i++ {
+		if _, ok, err := s.claim("test", now); !ok || err != nil {
+			t.Fatalf("claim = %v, %v", ok, err)
+		}
+	}
+
+	s, err = openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, retried := s.data.Jobs[1], s.data.Jobs[2]
+	if last.Status != StatusDead || last.Attempts != 1 || last.LastError == "" {
+		t.Errorf("job on its last attempt = %+v, want dead after 1 attempt", last)
+	}
+	if retried.Status != StatusQueued || retried.Attempts != 1 {
+		t.Errorf("job with attempts left = %+v, want queued after 1 attempt", retried)
+	}
+	if len(s.interrupted) != 1 || s.interrupted[0].Id != last.Id {
+		t.Errorf("interrupted = %+v, want only job %d", s.interrupted, last.Id)
+	}
+
+	job, ok, err := s.claim("test", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || job.Id != retried.Id || job.Attempts != 2 {
+		t.Errorf("claim = %+v, %v, want job %d on its second attempt", job, ok, retried.Id)
+	}
+	if _, ok, _ := s.claim("test", now); ok {
+		t.Error("the dead job was claimed")
+	}
+}
+
+func TestStartReportsInterruptedJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	s, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.add(Job{Kind: "test", Status: StatusQueued, MaxAttempts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.claim("test", time.Now()); !ok || err != nil {
+		t.Fatalf("claim = %v, %v", ok, err)
+	}
+
+	q, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := []Job{}
+	q.Register("test", func(ctx context.Context, job Job) error { return nil }, Options{
+		Interrupted: func(ctx context.Context, job Job) { interrupted = append(interrupted, job) },
+	})
+	q.Start()
+	defer q.Shutdown(context.Background())
+	if len(interrupted) != 1 || interrupted[0].Id != 1 || interrupted[0].Status != StatusDead {
+		t.Errorf("interrupted = %+v, want dead job 1", interrupted)
+	}
+}
+
+func TestPurgeDead(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, job := range []Job{
+		{Kind: "test", Status: StatusDead, RunAt: now.Add(-2 * time.Hour).UnixMilli()},
+		{Kind: "test", Status: StatusDead, RunAt: now.UnixMilli()},
+		{Kind: "test", Status: StatusQueued, RunAt: now.Add(-2 * time.Hour).UnixMilli()},
+	} {
+		if _, err := s.add(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := s.purgeDead(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("purged %d jobs, want 1", purged)
+	}
+	if _, ok := s.data.Jobs[1]; ok {
+		t.Error("the old dead job is still stored")
+	}
+	if len(s.data.Jobs) != 2 {
+		t.Errorf("%d jobs left, want 2", len(s.data.Jobs))
+	}
+}
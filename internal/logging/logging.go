@@ -0,0 +1,157 @@
+// Package logging sets up structured logging with log/slog. Records carry
+// the request ID and trace ID stored in their context, and anything that
+// looks like a credential is redacted before it's written.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	redacted = "[REDACTED]"
+)
+
+type contextKey struct{}
+
+// WithRequestID returns a context whose log records carry id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// RequestID returns the request ID stored by WithRequestID.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// ParseLevel accepts debug, info, warn and error.
+func ParseLevel(s string) (slog.Level, error) {
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// New returns a logger writing text or JSON records of at least level to w.
+// Records are also kept in recent, unless it's nil.
+func New(w io.Writer, format string, level slog.Level,
+	recent *Recent) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+	var handler slog.Handler
+	switch format {
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	if recent != nil {
+		handler = multiHandler{handler, recent.handler()}
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// contextHandler adds the request ID and the trace ID from the record's
+// context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+var (
+	// jwtRe matches the three base64url parts of a JWT.
+	jwtRe = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	// credentialRe matches an Authorization header value.
+	credentialRe = regexp.MustCompile(`(?i)\b(Bearer|ApiKey|Basic)\s+\S+`)
+)
+
+// sensitiveKeys are the attribute keys whose values are credentials. Keys
+// are matched whole, so counts like revoked_tokens aren't redacted.
+var sensitiveKeys = map[string]bool{
+	"password":         true,
+	"current_password": true,
+	"new_password":     true,
+	"token":            true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"challenge_token":  true,
+	"secret":           true,
+	"jwt_secret":       true,
+	"totp_secret":      true,
+	"recovery_code":    true,
+	"recovery_codes":   true,
+	"authorization":    true,
+	"cookie":           true,
+	"set_cookie":       true,
+	"apikey":           true,
+	"api_key":          true,
+	"x_api_key":        true,
+	"admin_api_key":    true,
+	"polka_api_key":    true,
+	"smtp_password":    true,
+}
+
+// sensitiveKey reports whether values logged under key are credentials.
+// Header names like Set-Cookie match too.
+func sensitiveKey(key string) bool {
+	return sensitiveKeys[strings.ReplaceAll(strings.ToLower(key), "-", "_")]
+}
+
+// Redact replaces JWTs and Authorization header values in s.
+func Redact(s string) string {
+	s = jwtRe.ReplaceAllString(s, redacted)
+	return credentialRe.ReplaceAllString(s, "$1 "+redacted)
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); Redact(s) != s {
+			return slog.String(a.Key, Redact(s))
+		}
+	case slog.KindAny:
+		// Errors may quote the input they failed on.
+		if err, ok := a.Value.Any().(error); ok {
+			if s := err.Error(); Redact(s) != s {
+				return slog.String(a.Key, Redact(s))
+			}
+		}
+	}
+	return a
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a log record kept by Recent. Attrs are formatted like the text
+// output, redacted.
+type Entry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   string
+}
+
+// Recent keeps the last records of at least a level in memory, so they can
+// be shown without access to the log output.
+type Recent struct {
+	mux     *sync.Mutex
+	level   slog.Level
+	entries []Entry
+	// next is the index the next entry is written to once entries is full.
+	next int
+	// buf is where the handlers format attributes, guarded by mux.
+	buf *bytes.Buffer
+}
+
+// NewRecent keeps up to size records of at least level.
+func NewRecent(size int, level slog.Level) *Recent {
+	return &Recent{
+		mux:     &sync.Mutex{},
+		level:   level,
+		entries: make([]Entry, 0, size),
+		buf:     &bytes.Buffer{},
+	}
+}
+
+// Entries returns the kept records, newest first.
+func (r *Recent) Entries() []Entry {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	entries := make([]Entry, 0, len(r.entries))
+	for i := 1; i <= len(r.entries); i++ {
+		entries = append(entries, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return entries
+}
+
+func (r *Recent) add(entry Entry) {
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, entry)
+		r.next = len(r.entries) % cap(r.entries)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+func (r *Recent) handler() slog.Handler {
+	return recentHandler{
+		recent: r,
+		text: slog.NewTextHandler(r.buf, &slog.HandlerOptions{
+			Level: r.level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// The entry has its own fields for these.
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+					return slog.Attr{}
+				}
+				return redactAttr(groups, a)
+			},
+		}),
+	}
+}
+
+type recentHandler struct {
+	recent *Recent
+	text   slog.Handler
+}
+
+func (h recentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.recent.level
+}
+
+func (h recentHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.recent.mux.Lock()
+	defer h.recent.mux.Unlock()
+
+	h.recent.buf.Reset()
+	if err := h.text.Handle(ctx, record); err != nil {
+		return err
+	}
+	h.recent.add(Entry{
+		Time:    record.Time,
+		Level:   record.Level,
+		Message: Redact(record.Message),
+		Attrs:   strings.TrimSpace(h.recent.buf.String()),
+	})
+	return nil
+}
+
+func (h recentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return recentHandler{h.recent, h.text.WithAttrs(attrs)}
+}
+
+func (h recentHandler) WithGroup(name string) slog.Handler {
+	return recentHandler{h.recent, h.text.WithGroup(name)}
+}
+
+// multiHandler passes records on to every handler that's enabled for them.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if !h.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, record.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
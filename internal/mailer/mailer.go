@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTP returns a mailer sending through the SMTP server at host:port.
+// Authentication is skipped when username is empty.
+func NewSMTP(host string, port string, username string, password string, from string) *SMTPMailer {
+	m := SMTPMailer{
+		addr: host + ":" + port,
+		from: from,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &m
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// LocalMailer doesn't deliver anything. Messages are appended to a file, or
+// logged when no path is set, which is handy for development and tests.
+type LocalMailer struct {
+	path string
+	mux  *sync.Mutex
+}
+
+func NewLocal(path string) *LocalMailer {
+	return &LocalMailer{
+		path: path,
+		mux:  &sync.Mutex{},
+	}
+}
+
+func (m *LocalMailer) Send(msg Message) error {
+	dat := formatMessage("chirpy@localhost", msg)
+	if m.path == "" {
+		// Tokens in the body are redacted by the logger, set a path to
+		// see them.
+		slog.Info("Mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(dat, '\n'))
+	return err
+}
+
+func formatMessage(from string, msg Message) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return []byte(fmt.Sprintf("%s\r\n\r\n%s\r\n", strings.Join(headers, "\r\n"), msg.Body))
+}
@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"sync"
+)
+
+type Event struct {
+	Id   uint64
+	Type string
+	Data interface{}
+}
+
+// Hub fans published events out to subscribers and keeps the most recent
+// ones around so subscribers can resume after a disconnect.
+type Hub struct {
+	mux         *sync.Mutex
+	lastId      uint64
+	buffer      []Event
+	bufferSize  int
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	// C receives the events. It's closed when the subscription ends,
+	// including when the subscriber falls too far behind.
+	C   <-chan Event
+	c   chan Event
+	hub *Hub
+}
+
+func NewHub(bufferSize int) *Hub {
+	return &Hub{
+		mux:         &sync.Mutex{},
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *Hub) Publish(eventType string, data interface{}) Event {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.lastId++
+	event := Event{Id: h.lastId, Type: eventType, Data: data}
+
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > h.bufferSize {
+		h.buffer = append(h.buffer[:0:0], h.buffer[len(h.buffer)-h.bufferSize:]...)
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.c <- event:
+		default:
+			// A subscriber that can't keep up is dropped rather than
+			// blocking everyone else. It can resume from its last event.
+			h.unsubscribe(sub)
+		}
+	}
+	return event
+}
+
+// Subscribe registers a subscriber whose channel holds up to queueSize
+// undelivered events. If lastId is non-zero, the buffered events after it
+// are returned as backlog; complete is false if some of them were already
+// evicted from the buffer.
+func (h *Hub) Subscribe(lastId uint64, queueSize int) (sub *Subscription, backlog []Event, complete bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	c := make(chan Event, queueSize)
+	sub = &Subscription{C: c, c: c, hub: h}
+	h.subscribers[sub] = struct{}{}
+
+	if lastId == 0 {
+		return sub, nil, true
+	}
+	// An id from the future most likely comes from before a restart.
+	if lastId > h.lastId {
+		return sub, nil, false
+	}
+	complete = lastId == h.lastId || (len(h.buffer) > 0 && h.buffer[0].Id <= lastId+1)
+	for _, event := range h.buffer {
+		if event.Id > lastId {
+			backlog = append(backlog, event)
+		}
+	}
+	return sub, backlog, complete
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+func (s *Subscription) Close() {
+	s.hub.mux.Lock()
+	defer s.hub.mux.Unlock()
+	s.hub.unsubscribe(s)
+}
@@ -0,0 +1,156 @@
+// Package seed generates fake but plausible users, chirps, follows and likes
+// for development. The same options always generate the same data.
+package seed
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+type Options struct {
+	// Seed makes the generated data reproducible.
+	Seed   int64
+	Users  int
+	Chirps int
+	// Days spreads signups and chirps over the days before Now.
+	Days int
+	Now  time.Time
+	// PasswordHash is stored for every user, so they can all log in with
+	// the same password.
+	PasswordHash string
+	// MaxChirpLength caps the chirp bodies.
+	MaxChirpLength int
+}
+
+var (
+	firstNames = []string{
+		"ada", "alan", "barbara", "brian", "claude", "dennis", "donald", "edsger",
+		"frances", "grace", "guido", "hedy", "ivan", "jean", "john", "ken",
+		"leslie", "linus", "margaret", "niklaus", "radia", "rob", "shafi", "sophie",
+		"tim", "tony", "vint", "whitfield", "yukihiro", "karen",
+	}
+	lastNames = []string{
+		"lovelace", "turing", "liskov", "kernighan", "shannon", "ritchie", "knuth", "dijkstra",
+		"allen", "hopper", "rossum", "lamarr", "sutherland", "sammet", "backus", "thompson",
+		"lamport", "torvalds", "hamilton", "wirth", "perlman", "pike", "goldwasser", "wilson",
+		"berners-lee", "hoare", "cerf", "diffie", "matsumoto", "jones",
+	}
+	openers = []string{
+		"Just shipped", "Finally fixed", "Spent all day on", "Can't stop thinking about",
+		"Hot take:", "Reminder:", "Today I learned about", "Who else loves",
+		"Reading up on", "Pairing on", "Refactoring", "Debugging",
+	}
+	topics = []string{
+		"the new release", "a flaky test", "garbage collection", "our deploy pipeline",
+		"type inference", "race conditions", "the database migration", "code review",
+		"a memory leak", "error handling", "the on-call rotation", "API design",
+		"dark mode", "coffee", "rubber duck debugging", "technical debt",
+	}
+	closers = []string{
+		"", "", "What a week.", "Send help.", "Worth it.", "Ask me anything.",
+		"More soon!", "Thoughts?", "10/10 would do again.", "#golang", "#devlife",
+	}
+	replies = []string{
+		"Totally agree!", "Hard disagree, but fair point.", "Same here.", "This is the way.",
+		"Great thread.", "Could you share more details?", "Been there.", "Congrats!",
+	}
+)
+
+// Generate returns the data to import. Users are named after computing
+// pioneers, chirps are written by a few prolific authors and many quiet
+// ones, and about a fifth of them are replies.
+func Generate(opts Options) database.ImportData {
+	r := rand.New(rand.NewSource(opts.Seed))
+	days := max(opts.Days, 1)
+	start := opts.Now.Add(-time.Duration(days) * 24 * time.Hour)
+
+	data := database.ImportData{
+		Follows: make(map[int][]int),
+		Likes:   make(map[int][]int),
+	}
+
+	emails := make(map[string]bool)
+	for i := 0; i < opts.Users; i++ {
+		first := firstNames[r.Intn(len(firstNames))]
+		last := lastNames[r.Intn(len(lastNames))]
+		email := fmt.Sprintf("%s.%s@example.com", first, last)
+		for n := 2; emails[email]; n++ {
+			email = fmt.Sprintf("%s.%s%d@example.com", first, last, n)
+		}
+		emails[email] = true
+
+		data.Users = append(data.Users, database.User{
+			Email:         email,
+			Password:      opts.PasswordHash,
+			ChirpyRed:     r.Intn(10) == 0,
+			EmailVerified: r.Intn(5) != 0,
+			CreatedAt:     randomTime(r, start, opts.Now).UnixMilli(),
+		})
+	}
+	if len(data.Users) == 0 {
+		return data
+	}
+
+	for i := 0; i < opts.Chirps; i++ {
+		// Squaring skews authorship towards the first users.
+		author := int(float64(len(data.Users))*squared(r.Float64())) + 1
+		signedUp := time.UnixMilli(data.Users[author-1].CreatedAt)
+		chirp := database.Chirp{
+			UserId:    author,
+			CreatedAt: randomTime(r, signedUp, opts.Now).UnixMilli(),
+		}
+		if i > 0 && r.Intn(5) == 0 {
+			chirp.ReplyTo = r.Intn(i) + 1
+			chirp.Body = replies[r.Intn(len(replies))]
+			chirp.CreatedAt = max(chirp.CreatedAt, data.Chirps[chirp.ReplyTo-1].CreatedAt+1)
+		} else {
+			chirp.Body = chirpBody(r)
+		}
+		if opts.MaxChirpLength > 0 && len(chirp.Body) > opts.MaxChirpLength {
+			chirp.Body = chirp.Body[:opts.MaxChirpLength]
+		}
+		data.Chirps = append(data.Chirps, chirp)
+	}
+
+	for follower := 1; follower <= len(data.Users); follower++ {
+		for n := r.Intn(min(8, len(data.Users))); n > 0; n-- {
+			followee := r.Intn(len(data.Users)) + 1
+			if followee != follower {
+				data.Follows[follower] = append(data.Follows[follower], followee)
+			}
+		}
+	}
+
+	for chirp := 1; chirp <= len(data.Chirps); chirp++ {
+		for n := r.Intn(min(6, len(data.Users))); n > 0; n-- {
+			liker := r.Intn(len(data.Users)) + 1
+			if liker != data.Chirps[chirp-1].UserId {
+				data.Likes[chirp] = append(data.Likes[chirp], liker)
+			}
+		}
+	}
+	return data
+}
+
+func chirpBody(r *rand.Rand) string {
+	parts := []string{openers[r.Intn(len(openers))], topics[r.Intn(len(topics))] + "."}
+	if closer := closers[r.Intn(len(closers))]; closer != "" {
+		parts = append(parts, closer)
+	}
+	return strings.Join(parts, " ")
+}
+
+func randomTime(r *rand.Rand, from time.Time, to time.Time) time.Time {
+	if !to.After(from) {
+		return from
+	}
+	return from.Add(time.Duration(r.Int63n(int64(to.Sub(from)))))
+}
+
+func squared(f float64) float64 {
+	return f * f
+}
@@ -0,0 +1,62 @@
+package validation
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// bcrypt only looks at the first 72 bytes of a password.
+const maxPasswordBytes = 72
+
+type PasswordPolicy struct {
+	MinLength int
+	breached  map[string]struct{}
+}
+
+// NewPasswordPolicy creates a policy requiring at least minLength
+// characters. If breachedListPath is set, passwords listed in that file (one
+// per line) are rejected too.
+func NewPasswordPolicy(minLength int, breachedListPath string) (*PasswordPolicy, error) {
+	policy := PasswordPolicy{
+		MinLength: minLength,
+		breached:  make(map[string]struct{}),
+	}
+	if breachedListPath == "" {
+		return &policy, nil
+	}
+
+	f, err := os.Open(breachedListPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			policy.breached[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Check returns the error code for the first rule password breaks, or an
+// empty string if it's acceptable.
+func (p *PasswordPolicy) Check(password string) string {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return CodeTooShort
+	}
+	if len(password) > maxPasswordBytes {
+		return CodeTooLong
+	}
+	if _, ok := p.breached[password]; ok {
+		return CodeBreached
+	}
+	return ""
+}
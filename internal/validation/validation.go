@@ -0,0 +1,91 @@
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+const (
+	CodeRequired      = "required"
+	CodeInvalidFormat = "invalid_format"
+	CodeInvalidType   = "invalid_type"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeBreached      = "breached"
+	CodeAlreadyTaken  = "already_taken"
+	CodeUnknownField  = "unknown_field"
+)
+
+type FieldError struct {
+	Field string `json:"field"`
+	Code  string `json:"code"`
+}
+
+// Errors is the error returned when validation fails. It marshals to
+// {"errors":[{"field":"email","code":"invalid_format"}]}.
+type Errors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e Errors) Error() string {
+	parts := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		parts = append(parts, fe.Field+": "+fe.Code)
+	}
+	return fmt.Sprintf("validation failed: %s", strings.Join(parts, ", "))
+}
+
+func NewErrors(field string, code string) Errors {
+	return Errors{Errors: []FieldError{{Field: field, Code: code}}}
+}
+
+// Validator collects field errors so a client gets all of them at once
+// instead of fixing one field per request.
+type Validator struct {
+	errs []FieldError
+}
+
+func (v *Validator) AddError(field string, code string) {
+	v.errs = append(v.errs, FieldError{Field: field, Code: code})
+}
+
+// Required reports whether value is non-empty, recording an error if not.
+func (v *Validator) Required(field string, value string) bool {
+	if value == "" {
+		v.AddError(field, CodeRequired)
+		return false
+	}
+	return true
+}
+
+func (v *Validator) Email(field string, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		v.AddError(field, CodeInvalidFormat)
+	}
+}
+
+func (v *Validator) Password(field string, value string, policy *PasswordPolicy) {
+	if !v.Required(field, value) {
+		return
+	}
+	if code := policy.Check(value); code != "" {
+		v.AddError(field, code)
+	}
+}
+
+func (v *Validator) Valid() bool {
+	return len(v.errs) == 0
+}
+
+// Err returns the collected errors, or nil if there aren't any.
+func (v *Validator) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	return Errors{Errors: v.errs}
+}
@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmail(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []FieldError
+	}{
+		{"jo@example.com", nil},
+		{"", []FieldError{{"email", CodeRequired}}},
+		{"jo", []FieldError{{"email", CodeInvalidFormat}}},
+		{"jo@", []FieldError{{"email", CodeInvalidFormat}}},
+		{"Jo <jo@example.com>", []FieldError{{"email", CodeInvalidFormat}}},
+		{" jo@example.com", []FieldError{{"email", CodeInvalidFormat}}},
+	}
+	for _, tt := range tests {
+		v := Validator{}
+		v.Email("email", tt.value)
+		if !reflect.DeepEqual(v.errs, tt.want) {
+			t.Errorf("Email(%q) = %v, want %v", tt.value, v.errs, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breached, []byte("password123\n\n  letmein99  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewPasswordPolicy(8, breached)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"correct-horse", ""},
+		{"short", CodeTooShort},
+		// Length is counted in characters, not bytes.
+		{"ééééééé", CodeTooShort},
+		{"éééééééé", ""},
+		{strings.Repeat("a", maxPasswordBytes), ""},
+		{strings.Repeat("a", maxPasswordBytes+1), CodeTooLong},
+		{"password123", CodeBreached},
+		{"letmein99", CodeBreached},
+	}
+	for _, tt := range tests {
+		if got := policy.Check(tt.password); got != tt.want {
+			t.Errorf("Check(%q) = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestNewPasswordPolicyMissingList(t *testing.T) {
+	if _, err := NewPasswordPolicy(8, filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("NewPasswordPolicy succeeded without the breached passwords list")
+	}
+}
+
+func TestValidatorCollectsEveryError(t *testing.T) {
+	policy, err := NewPasswordPolicy(8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Validator{}
+	v.Email("email", "jo")
+	v.Password("password", "", policy)
+	err = v.Err()
+	want := Errors{Errors: []FieldError{{"email", CodeInvalidFormat}, {"password", CodeRequired}}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("Err() = %v, want %v", err, want)
+	}
+	if (&Validator{}).Err() != nil {
+		t.Error("Err() of an empty validator isn't nil")
+	}
+}
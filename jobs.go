@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+)
+
+const (
+	jobSendEmail      = "email.send"
+	jobDeliverWebhook = "webhook.deliver"
+	jobCleanup        = "cleanup"
+	jobBackup         = "backup"
+
+	cleanupSchedule = "@hourly"
+	// Delivered webhook deliveries are kept in the log this long.
+	webhookDeliveryRetention = 7 * 24 * time.Hour
+	// Dead jobs are kept for inspection this long.
+	deadJobRetention = 7 * 24 * time.Hour
+)
+
+// registerJobs sets up the handlers and schedules of every background job.
+func (ac *apiConfig) registerJobs() error {
+	ac.jobs.Register(jobSendEmail, traceJob(ac.sendEmailJob), jobs.Options{
+		Concurrency: 2,
+		MaxAttempts: 5,
+		Backoff:     jobs.ExponentialBackoff(10*time.Second, 10*time.Minute),
+		Timeout:     30 * time.Second,
+	})
+	ac.jobs.Register(jobDeliverWebhook, traceJob(ac.deliverWebhookJob), jobs.Options{
+		Concurrency: 4,
+		MaxAttempts: webhookMaxAttempts,
+		Backoff:     webhookBackoff,
+		Timeout:     webhookTimeout,
+		Interrupted: ac.interruptedWebhookJob,
+	})
+	ac.jobs.Register(jobCleanup, traceJob(ac.cleanupJob), jobs.Options{
+		MaxAttempts: 1,
+	})
+	ac.jobs.Register(jobBackup, traceJob(ac.backupJob), jobs.Options{
+		MaxAttempts: 1,
+	})
+	if err := ac.jobs.Schedule(cleanupSchedule, jobCleanup, nil); err != nil {
+		return err
+	}
+	if ac.config.Backup.Schedule == "" {
+		return nil
+	}
+	return ac.jobs.Schedule(ac.config.Backup.Schedule, jobBackup, nil)
+}
+
+func (ac *apiConfig) sendEmailJob(ctx context.Context, job jobs.Job) error {
+	payload := emailJobPayload{}
+	if err := job.Decode(&payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	user, err := ac.db.FindUserById(ctx, payload.UserId)
+	if errors.Is(err, database.ErrNotExist) {
+		// The user was deleted in the meantime.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if payload.Kind == emailVerification && user.EmailVerified {
+		return nil
+	}
+	msg, err := ac.composeEmail(user, payload.Kind)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	return ac.mailer.Send(msg)
+}
+
+// cleanupJob removes data nobody needs anymore, so the database file doesn't
+// grow forever.
+func (ac *apiConfig) cleanupJob(ctx context.Context, job jobs.Job) error {
+	now := time.Now()
+	tokens, err := ac.db.PurgeRevokedTokens(ctx, now.Add(-ac.config.Tokens.RefreshTTL))
+	if err != nil {
+		return err
+	}
+	attempts, err := ac.db.PurgeLoginAttempts(ctx, now.Add(-loginFailureWindow))
+	if err != nil {
+		return err
+	}
+	deliveries, err := ac.db.PurgeWebhookDeliveries(ctx, now.Add(-webhookDeliveryRetention))
+	if err != nil {
+		return err
+	}
+	deadJobs, err := ac.jobs.PurgeDead(now.Add(-deadJobRetention))
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Cleanup finished", "revoked_tokens", tokens, "login_attempts", attempts, "webhook_deliveries", deliveries, "dead_jobs", deadJobs)
+	return nil
+}
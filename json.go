@@ -2,29 +2,47 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
+
+	"github.com/petomackay/chirpy/internal/validation"
 )
 
-func handleError(errorMsg string, statusCode int, w http.ResponseWriter) {
-	type errorBody struct {
-		Error string `json:"error"`
+const maxJSONBodyBytes = 1 << 20
+
+// decodeJSONBody strictly decodes a single JSON object into dst: unknown
+// fields, trailing data and bodies over maxJSONBodyBytes are rejected.
+// Errors are returned as validation.Errors.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return decodeError(err)
 	}
-	errorData := errorBody{
-		Error: errorMsg,
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return validation.NewErrors("body", validation.CodeInvalidFormat)
 	}
-	sendJson(errorData, statusCode, w)
+	return nil
 }
 
-func sendJson(data interface{}, statusCode int, w http.ResponseWriter) {
-	dat, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		handleError(fmt.Sprintf("Error marshalling JSON: %s", err), http.StatusInternalServerError, w)
-		return
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return validation.NewErrors("body", validation.CodeTooLong)
+	case errors.As(err, &typeErr):
+		return validation.NewErrors(typeErr.Field, validation.CodeInvalidType)
+	case errors.Is(err, io.EOF):
+		return validation.NewErrors("body", validation.CodeRequired)
+	}
+	// encoding/json has no typed error for unknown fields.
+	if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+		return validation.NewErrors(strings.Trim(field, `"`), validation.CodeUnknownField)
 	}
-	w.WriteHeader(statusCode)
-	w.Write(dat)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return validation.NewErrors("body", validation.CodeInvalidFormat)
 }
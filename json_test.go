@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"valid", `{"email":"jo@example.com","password":"secret"}`, nil},
+		{"empty", ``, validation.NewErrors("body", validation.CodeRequired)},
+		{"malformed", `{"email":`, validation.NewErrors("body", validation.CodeInvalidFormat)},
+		{"unknown field", `{"email":"jo@example.com","admin":true}`, validation.NewErrors("admin", validation.CodeUnknownField)},
+		{"wrong type", `{"email":42}`, validation.NewErrors("email", validation.CodeInvalidType)},
+		{"trailing data", `{"email":"jo@example.com"} {}`, validation.NewErrors("body", validation.CodeInvalidFormat)},
+		{"too long", `{"email":"` + strings.Repeat("a", maxJSONBodyBytes) + `"}`, validation.NewErrors("body", validation.CodeTooLong)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			body := userBody{}
+			err := decodeJSONBody(httptest.NewRecorder(), req, &body)
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("decodeJSONBody = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostUsersHandlerValidates(t *testing.T) {
+	ac := newTestAPI(t)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErrors []validation.FieldError
+	}{
+		{"valid", `{"email":"jo@example.com","password":"correct-horse"}`, http.StatusCreated, nil},
+		{"taken", `{"email":"jo@example.com","password":"correct-horse"}`, http.StatusBadRequest,
+			[]validation.FieldError{{Field: "email", Code: validation.CodeAlreadyTaken}}},
+		{"empty password", `{"email":"sam@example.com","password":""}`, http.StatusBadRequest,
+			[]validation.FieldError{{Field: "password", Code: validation.CodeRequired}}},
+		{"every field", `{"email":"sam","password":"short"}`, http.StatusBadRequest,
+			[]validation.FieldError{{Field: "email", Code: validation.CodeInvalidFormat}, {Field: "password", Code: validation.CodeTooShort}}},
+		{"unknown field", `{"email":"sam@example.com","password":"correct-horse","is_chirpy_red":true}`, http.StatusBadRequest,
+			[]validation.FieldError{{Field: "is_chirpy_red", Code: validation.CodeUnknownField}}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/users", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		ac.postUsersHandler(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantErrors == nil {
+			continue
+		}
+		problem := problemDetails{}
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(problem.Errors, tt.wantErrors) {
+			t.Errorf("%s: errors = %v, want %v", tt.name, problem.Errors, tt.wantErrors)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs the server and the background workers until SIGINT or SIGTERM,
+// then shuts everything down in order: readiness goes unhealthy, the server
+// drains its connections, the workers finish their jobs, buffered spans are
+// exported and the database is closed once the last write has landed. A
+// second signal exits immediately.
+func (ac *apiConfig) serve(server *http.Server) error {
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	// Event streams and websockets never finish on their own, so tell them
+	// to wrap up when the server starts shutting down.
+	server.RegisterOnShutdown(func() {
+		close(ac.shutdown)
+	})
+
+	ac.jobs.Start()
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	dispatchDone := make(chan struct{})
+	go func() {
+		ac.runWebhookDispatcher(dispatchCtx)
+		close(dispatchDone)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		stopDispatch()
+		return err
+	case <-ctx.Done():
+	}
+	stopSignals()
+
+	slog.Info("Shutting down")
+	ac.draining.Store(true)
+	if delay := ac.config.Server.ShutdownDelay; delay > 0 {
+		// Give load balancers time to notice the failing readiness check
+		// before the listener goes away.
+		time.Sleep(delay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ac.config.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Couldn't drain all connections", "err", err)
+		server.Close()
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server error", "err", err)
+	}
+
+	stopDispatch()
+	<-dispatchDone
+	if err := ac.jobs.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Couldn't finish all running jobs", "err", err)
+	}
+	if err := ac.flushTraces(shutdownCtx); err != nil {
+		slog.Warn("Couldn't export the remaining spans", "err", err)
+	}
+	if err := ac.db.Close(); err != nil {
+		return err
+	}
+	slog.Info("Shutdown complete")
+	return nil
+}
+
+// clearDeadlines lifts the server's read and write timeouts for responses
+// that stay open, like event streams. Without it they'd be cut off after the
+// configured write timeout.
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Couldn't clear the read deadline", "err", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Couldn't clear the write deadline", "err", err)
+	}
+}
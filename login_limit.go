@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+const (
+	maxAccountLoginFailures = 5
+	maxIPLoginFailures      = 20
+	loginBackoffBase        = time.Second
+	loginBackoffMax         = 5 * time.Minute
+	loginLockoutDuration    = 15 * time.Minute
+	// Failures older than this are forgotten.
+	loginFailureWindow = time.Hour
+)
+
+func accountLoginKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLoginKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// loginRetryAfter returns how long the caller has to wait before key is
+// allowed another login attempt. Zero means the attempt may proceed.
+func (ac *apiConfig) loginRetryAfter(ctx context.Context, key string, now time.Time) time.Duration {
+	attempt, err := ac.db.GetLoginAttempt(ctx, key)
+	if errors.Is(err, database.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't load login attempts", "login_key", key, "err", err)
+		return 0
+	}
+
+	if lockedUntil := time.UnixMilli(attempt.LockedUntil); now.Before(lockedUntil) {
+		return lockedUntil.Sub(now)
+	}
+	lastFailure := time.UnixMilli(attempt.LastFailure)
+	if now.Sub(lastFailure) > loginFailureWindow {
+		return 0
+	}
+	if next := lastFailure.Add(loginBackoff(attempt.Failures)); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// loginBackoff doubles the wait after every failure, starting at
+// loginBackoffBase and capped at loginBackoffMax.
+func loginBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	backoff := loginBackoffBase
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= loginBackoffMax {
+			return loginBackoffMax
+		}
+	}
+	return backoff
+}
+
+// recordLoginFailure counts a failed login for key. Reading and saving the
+// count is a single database write, so concurrent failures all count and
+// can't undo other writes.
+func (ac *apiConfig) recordLoginFailure(ctx context.Context, key string, maxFailures int, now time.Time) {
+	attempt, err := ac.db.UpdateLoginAttempt(ctx, key, func(attempt database.LoginAttempt) database.LoginAttempt {
+		if now.Sub(time.UnixMilli(attempt.LastFailure)) > loginFailureWindow {
+			attempt = database.LoginAttempt{}
+		}
+		attempt.Failures++
+		attempt.LastFailure = now.UnixMilli()
+		if attempt.Failures >= maxFailures && attempt.LockedUntil < now.UnixMilli() {
+			attempt.LockedUntil = now.Add(loginLockoutDuration).UnixMilli()
+		}
+		return attempt
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't save login attempts", "login_key", key, "err", err)
+		return
+	}
+	if attempt.Failures == maxFailures {
+		slog.WarnContext(ctx, "Locking out after failed logins", "login_key", key, "failures", attempt.Failures)
+	}
+}
+
+func (ac *apiConfig) clearLoginFailures(ctx context.Context, key string) {
+	err := ac.db.ClearLoginAttempts(ctx, key)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		slog.ErrorContext(ctx, "Couldn't clear login attempts", "login_key", key, "err", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{9, 256 * time.Second},
+		{10, loginBackoffMax},
+		{100, loginBackoffMax},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failures int
+		// at is how long after the last failure the next attempt comes.
+		at   time.Duration
+		want time.Duration
+	}{
+		{"no failures", 0, 0, 0},
+		{"backing off", 1, 0, time.Second},
+		{"backoff over", 1, time.Second, 0},
+		{"backoff grows", maxAccountLoginFailures - 1, time.Second, loginBackoff(maxAccountLoginFailures-1) - time.Second},
+		{"locked out at the threshold", maxAccountLoginFailures, time.Minute, loginLockoutDuration - time.Minute},
+		{"lockout over", maxAccountLoginFailures, loginLockoutDuration, 0},
+		{"failures forgotten", maxAccountLoginFailures - 1, loginFailureWindow + time.Second, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := newTestAPI(t)
+			ctx := context.Background()
+			key := accountLoginKey("jo@example.com")
+			for i := 0; i < tt.failures; i++ {
+				ac.recordLoginFailure(ctx, key, maxAccountLoginFailures, start)
+			}
+			if got := ac.loginRetryAfter(ctx, key, start.Add(tt.at)); got != tt.want {
+				t.Errorf("loginRetryAfter = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginFailuresReset(t *testing.T) {
+	ac := newTestAPI(t)
+	ctx := context.Background()
+	key := accountLoginKey("jo@example.com")
+	start := time.Now()
+	for i := 0; i < maxAccountLoginFailures-1; i++ {
+		ac.recordLoginFailure(ctx, key, maxAccountLoginFailures, start)
+	}
+
+	// A failure after the window starts counting from one again.
+	ac.recordLoginFailure(ctx, key, maxAccountLoginFailures, start.Add(loginFailureWindow+time.Second))
+	attempt, err := ac.db.GetLoginAttempt(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt.Failures != 1 || attempt.LockedUntil != 0 {
+		t.Errorf("attempt = %+v, want 1 failure and no lockout", attempt)
+	}
+
+	// A successful login forgets them.
+	ac.clearLoginFailures(ctx, key)
+	if _, err := ac.db.GetLoginAttempt(ctx, key); !errors.Is(err, database.ErrNotExist) {
+		t.Errorf("GetLoginAttempt = %v after clearing, want %v", err, database.ErrNotExist)
+	}
+}
+
+func TestUserLoginHandlerThrottles(t *testing.T) {
+	ac := newTestAPI(t)
+	hashed, err := hashPassword(context.Background(), "correct-horse-battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.db.CreateUser(context.Background(), "jo@example.com", hashed); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"email":"jo@example.com","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		ac.userLoginHandler(w, req)
+		return w
+	}
+
+	if w := login("wrong-password"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("first wrong password: status %d, want 401", w.Code)
+	}
+	// The next attempt has to wait for the backoff, even with the right
+	// password.
+	w := login("correct-horse-battery")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("login during the backoff: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	time.Sleep(loginBackoff(1))
+	if w := login("correct-horse-battery"); w.Code != http.StatusOK {
+		t.Errorf("login after the backoff: status %d, want 200", w.Code)
+	}
+}
@@ -1,62 +1,235 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/joho/godotenv"
+	"github.com/petomackay/chirpy/internal/config"
 	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+	"github.com/petomackay/chirpy/internal/logging"
+	"github.com/petomackay/chirpy/internal/mailer"
+	"github.com/petomackay/chirpy/internal/validation"
 )
 
 type apiConfig struct {
-	fileserverHits int
+	config         config.Config
+	fileserverHits atomic.Int64
 	jwtSecret      string
 	polkaApiKey    string
+	adminApiKey    string
+	publicURL      string
+	mailer         mailer.Mailer
+	passwordPolicy *validation.PasswordPolicy
 	db             *database.DB
+	rateLimiter    rateLimitStore
+	metrics        *metrics
+	health         *healthChecker
+	jobs           *jobs.Queue
+	// webhookNetworks are the private networks webhooks may be delivered
+	// to, and webhookClient delivers them.
+	webhookNetworks []netip.Prefix
+	webhookClient   *http.Client
+	// flushTraces exports the spans still buffered.
+	flushTraces func(context.Context) error
+	// recentErrors keeps the last error records for the dashboard.
+	recentErrors *logging.Recent
+	// draining is set once shutdown starts, failing the readiness check.
+	draining atomic.Bool
+	// shutdown is closed when the server starts shutting down.
+	shutdown chan struct{}
 }
 
+var (
+	chirpCreateLimit = rateLimitPolicy{
+		Name:     "chirps.create",
+		Limit:    10,
+		RedLimit: 30,
+		Period:   time.Minute,
+		Key:      rateLimitByUser,
+	}
+	chirpReadLimit = rateLimitPolicy{
+		Name:     "chirps.read",
+		Limit:    60,
+		RedLimit: 300,
+		Period:   time.Minute,
+		Key:      rateLimitByUser,
+	}
+)
+
 func main() {
 	godotenv.Load()
 
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-	if *dbg {
-		os.Remove("database.json")
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := runSeedCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdminCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	const port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	db, err := database.NewDB("database.json")
+	logLevel, err := logging.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
+	recentErrors := logging.NewRecent(recentErrorsSize, slog.LevelError)
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, logLevel, recentErrors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Also routes the log package, and so any library using it, through
+	// the logger.
+	slog.SetDefault(logger)
+
+	flushTraces, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Couldn't set up tracing", "err", err)
+	}
+
+	if cfg.Debug {
+		os.Remove(cfg.DBPath)
+		os.Remove(cfg.JobsPath)
+	}
+
+	db, err := database.NewDB(cfg.DBPath, cfg.Backup.Dir)
+	if err != nil {
+		fatal("Couldn't open the database", "path", cfg.DBPath, "err", err)
+	}
+
+	jobQueue, err := jobs.Open(cfg.JobsPath)
+	if err != nil {
+		fatal("Couldn't open the job queue", "path", cfg.JobsPath, "err", err)
+	}
+
+	passwordPolicy, err := validation.NewPasswordPolicy(cfg.PasswordMinLength, cfg.BreachedPasswordsPath)
+	if err != nil {
+		fatal("Couldn't load the breached passwords list", "err", err)
+	}
+
+	webhookNetworks, err := cfg.Webhooks.AllowedPrefixes()
+	if err != nil {
+		fatal("Couldn't parse the webhook networks", "err", err)
+	}
 
 	ac := apiConfig{
-		fileserverHits: 0,
-		jwtSecret:      os.Getenv("JWT_SECRET"),
-		polkaApiKey:    os.Getenv("POLKA_API_KEY"),
-		db:             db,
+		config:          cfg,
+		jwtSecret:       cfg.JWTSecret,
+		polkaApiKey:     cfg.PolkaAPIKey,
+		adminApiKey:     cfg.AdminAPIKey,
+		publicURL:       cfg.PublicURL,
+		mailer:          newMailer(cfg.Mail),
+		passwordPolicy:  passwordPolicy,
+		db:              db,
+		rateLimiter:     newMemoryRateLimitStore(),
+		jobs:            jobQueue,
+		webhookNetworks: webhookNetworks,
+		webhookClient:   newWebhookClient(webhookNetworks),
+		flushTraces:     flushTraces,
+		recentErrors:    recentErrors,
+		shutdown:        make(chan struct{}),
+	}
+
+	ac.metrics = newMetrics(&ac)
+	ac.health = newHealthChecker(map[string]checkFunc{
+		"database_read":  ac.checkDatabaseRead,
+		"database_write": ac.checkDatabaseWrite,
+		"disk":           ac.checkDisk,
+		"jobs":           ac.checkJobs,
+	})
+	db.SetObserver(ac.metrics.observeDB)
+
+	if err := ac.registerJobs(); err != nil {
+		fatal("Couldn't register jobs", "err", err)
 	}
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestID)
+	r.Use(middlewareTracing)
+	r.Use(middlewareRequestIDHeader)
+	r.Use(middlewareRequestLogger)
+	r.Use(ac.metrics.middleware)
+	r.Handle("/metrics", ac.metrics.handler())
 
 	apiRouter := chi.NewRouter()
-	apiRouter.Get("/healthz", healthzCallback)
-	apiRouter.Get("/reset", ac.resetCallback)
-	apiRouter.Get("/chirps", ac.getChirpsHandler)
-	apiRouter.Get("/chirps/{id}", ac.getChirpByIDHandler)
-	apiRouter.Post("/chirps", ac.postChirpHandler)
+	// /api/healthz predates the split and stays the readiness check.
+	apiRouter.Get("/healthz", ac.readyHandler)
+	apiRouter.Get("/healthz/ready", ac.readyHandler)
+	apiRouter.Get("/healthz/live", ac.liveHandler)
 	apiRouter.Post("/users", ac.postUsersHandler)
 	apiRouter.Post("/login", ac.userLoginHandler)
-	apiRouter.Put("/users", ac.putUsersHandler)
+	apiRouter.Post("/login/2fa", ac.twoFactorLoginHandler)
+	apiRouter.Post("/users/verify", ac.verifyEmailHandler)
+	apiRouter.Post("/password-reset", ac.passwordResetHandler)
+	apiRouter.Post("/password-reset/confirm", ac.passwordResetConfirmHandler)
 	apiRouter.Post("/refresh", ac.handleRefresh)
 	apiRouter.Post("/revoke", ac.handleRevoke)
-	apiRouter.Delete("/chirps/{id}", ac.deleteChirpHandler)
+
+	apiRouter.Get("/stream", ac.streamHandler)
+	apiRouter.Get("/ws", ac.wsHandler)
+
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(ac.middlewareAdmin)
+		r.Use(ac.middlewareDevOnly)
+		r.Post("/reset", ac.resetHandler)
+		r.Post("/seed", ac.seedHandler)
+	})
+
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(ac.middlewareAuthOptional)
+		r.Use(ac.middlewareRateLimit(chirpReadLimit))
+		r.Get("/chirps", ac.getChirpsHandler)
+		r.Get("/chirps/{id}", ac.getChirpByIDHandler)
+	})
+
+	apiRouter.Group(func(r chi.Router) {
+		r.Use(ac.middlewareAuthRequired)
+		r.With(ac.middlewareRateLimit(chirpCreateLimit)).Post("/chirps", ac.postChirpHandler)
+		r.Get("/users", ac.getUsersHandler)
+		r.Put("/users", ac.putUsersHandler)
+		r.Patch("/users", ac.patchUsersHandler)
+		r.Post("/users/2fa", ac.postTwoFactorHandler)
+		r.Post("/users/2fa/confirm", ac.postTwoFactorConfirmHandler)
+		r.Post("/users/{id}/follow", ac.postFollowHandler)
+		r.Delete("/users/{id}/follow", ac.deleteFollowHandler)
+		r.Get("/notifications", ac.getNotificationsHandler)
+		r.Post("/notifications/read", ac.postNotificationsReadHandler)
+		r.Get("/notifications/preferences", ac.getNotificationPrefsHandler)
+		r.Put("/notifications/preferences", ac.putNotificationPrefsHandler)
+		r.Post("/webhooks", ac.postWebhookHandler)
+		r.Get("/webhooks", ac.getWebhooksHandler)
+		r.Delete("/webhooks/{id}", ac.deleteWebhookHandler)
+		r.Get("/webhooks/{id}/deliveries", ac.getWebhookDeliveriesHandler)
+		r.Post("/webhooks/{id}/deliveries/{deliveryId}/retry", ac.retryWebhookDeliveryHandler)
+		r.Put("/chirps/{id}", ac.putChirpHandler)
+		r.Delete("/chirps/{id}", ac.deleteChirpHandler)
+		r.Post("/chirps/{id}/likes", ac.postChirpLikeHandler)
+		r.Delete("/chirps/{id}/likes", ac.deleteChirpLikeHandler)
+	})
 
 	polkaRouter := chi.NewRouter()
 	polkaRouter.Post("/webhooks", ac.handleWebhooks)
@@ -64,19 +237,50 @@ func main() {
 	r.Mount("/api", apiRouter)
 
 	adminRouter := chi.NewRouter()
-	adminRouter.Get("/metrics", ac.metricsCallback)
+	adminRouter.Group(func(r chi.Router) {
+		r.Use(ac.middlewareAdmin)
+		r.Get("/", ac.dashboardHandler)
+		r.Get("/metrics", ac.dashboardHandler)
+		r.Get("/healthz", ac.adminHealthHandler)
+		r.Get("/lockouts", ac.getLockoutsHandler)
+		r.Delete("/lockouts/{key}", ac.deleteLockoutHandler)
+		r.Get("/backups", ac.getBackupsHandler)
+		r.Post("/backups", ac.postBackupHandler)
+		r.Get("/export", ac.exportHandler)
+	})
 	r.Mount("/admin", adminRouter)
 
-	fsHandler := ac.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
+	fsHandler := ac.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(cfg.StaticDir))))
 	r.Handle("/app/*", fsHandler)
 	r.Handle("/app", fsHandler)
 
 	corsMux := middlewareCors(r)
 	server := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMux,
+		Addr:              ":" + strconv.Itoa(cfg.Port),
+		Handler:           corsMux,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	slog.Info("Serving", "port", cfg.Port)
+	if err := ac.serve(server); err != nil {
+		fatal("Server failed", "err", err)
 	}
+}
 
-	log.Printf("Serving on port: %s\n", port)
-	log.Fatal(server.ListenAndServe())
+// fatal logs msg as an error and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newMailer sends real emails when an SMTP host is configured and otherwise
+// falls back to writing them to the mail log, or the log.
+func newMailer(cfg config.MailConfig) mailer.Mailer {
+	if cfg.SMTPHost == "" {
+		return mailer.NewLocal(cfg.LogPath)
+	}
+	return mailer.NewSMTP(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/petomackay/chirpy/internal/config"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+// newTestAPI returns an apiConfig with the default config and a fresh
+// database in a temporary directory. Its job queue isn't started, so queued
+// jobs stay queued.
+func newTestAPI(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := database.NewDB(filepath.Join(dir, "database.json"), filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	jobQueue, err := jobs.Open(filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.JWTSecret = "test-secret"
+	passwordPolicy, err := validation.NewPasswordPolicy(cfg.PasswordMinLength, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &apiConfig{
+		config:         cfg,
+		jwtSecret:      cfg.JWTSecret,
+		passwordPolicy: passwordPolicy,
+		db:             db,
+		rateLimiter:    newMemoryRateLimitStore(),
+		jobs:           jobQueue,
+		webhookClient:  newWebhookClient(nil),
+		shutdown:       make(chan struct{}),
+	}
+	ac.metrics = newMetrics(ac)
+	return ac
+}
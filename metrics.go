@@ -1,32 +1,170 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const adminMetricsPage = `
-<html>
+// sessionWindow is how recently a user has to have made an authenticated
+// request to count as an active session.
+const sessionWindow = 15 * time.Minute
+
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	dbDuration      *prometheus.HistogramVec
+	dbErrors        *prometheus.CounterVec
+	chirpsCreated   prometheus.Counter
+	openStreams     *prometheus.GaugeVec
+	sessions        *sessionTracker
+}
+
+func newMetrics(ac *apiConfig) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chirpy_http_requests_total",
+			Help: "HTTP requests by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chirpy_http_request_duration_seconds",
+			Help:    "HTTP request latency by method, route pattern and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chirpy_db_operation_duration_seconds",
+			Help:    "Latency of database file reads and writes.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chirpy_db_operation_errors_total",
+			Help: "Failed database file reads and writes.",
+		}, []string{"op"}),
+		chirpsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chirpy_chirps_created_total",
+			Help: "Chirps created.",
+		}),
+		openStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chirpy_open_streams",
+			Help: "Open event streams by transport (sse or ws).",
+		}, []string{"transport"}),
+		sessions: newSessionTracker(),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.dbDuration,
+		m.dbErrors,
+		m.chirpsCreated,
+		m.openStreams,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "chirpy_fileserver_hits_total",
+			Help: "Requests served from /app.",
+		}, func() float64 {
+			return float64(ac.fileserverHits.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chirpy_db_file_size_bytes",
+			Help: "Size of the database file.",
+		}, func() float64 {
+			size, err := ac.db.Size()
+			if err != nil {
+				return 0
+			}
+			return float64(size)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "chirpy_active_sessions",
+			Help: "Users who made an authenticated request in the last 15 minutes.",
+		}, func() float64 {
+			return float64(m.sessions.active(time.Now()))
+		}),
+	)
+	return m
+}
 
-<body>
-    <h1>Welcome, Chirpy Admin</h1>
-    <p>Chirpy has been visited %d times!</p>
-</body>
+// observeDB is the database observer.
+func (m *metrics) observeDB(ctx context.Context, op string, duration time.Duration, err error) {
+	m.dbDuration.WithLabelValues(op).Observe(duration.Seconds())
+	if err != nil {
+		m.dbErrors.WithLabelValues(op).Inc()
+	}
+}
 
-</html>
-`
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
 
-func (cfg *apiConfig) metricsCallback(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(adminMetricsPage, cfg.fileserverHits)))
-	return
+// middleware counts requests and their latency by route pattern rather than
+// path, so ids in the path don't blow up the number of series.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			// Hijacked connections, like websockets, never write a status.
+			status = http.StatusSwitchingProtocols
+		}
+		labels := prometheus.Labels{"method": r.Method, "route": route, "status": strconv.Itoa(status)}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// sessionTracker remembers when each user was last authenticated.
+type sessionTracker struct {
+	mux      *sync.Mutex
+	lastSeen map[int]time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		mux:      &sync.Mutex{},
+		lastSeen: make(map[int]time.Time),
+	}
+}
+
+func (t *sessionTracker) seen(userId int, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.lastSeen[userId] = now
+}
+
+// active counts the users seen within sessionWindow and forgets the rest.
+func (t *sessionTracker) active(now time.Time) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for userId, lastSeen := range t.lastSeen {
+		if now.Sub(lastSeen) > sessionWindow {
+			delete(t.lastSeen, userId)
+		}
+	}
+	return len(t.lastSeen)
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.fileserverHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
-
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+// Users don't have handles, so chirps mention them by email: "@jo@example.com".
+var mentionRe = regexp.MustCompile(`@([A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+
+const (
+	defaultNotificationsLimit = 50
+	maxNotificationsLimit     = 100
+)
+
+type notificationsResponse struct {
+	UnreadCount   int                     `json:"unread_count"`
+	Notifications []database.Notification `json:"notifications"`
+}
+
+type markReadBody struct {
+	Ids []int `json:"ids"`
+}
+
+// notify records a notification for userId. Nobody is notified about their
+// own actions, and failures are only logged since the action that caused
+// the notification already succeeded.
+func (ac *apiConfig) notify(ctx context.Context, userId int, notificationType string, actorId int, chirpId int) {
+	if userId == actorId {
+		return
+	}
+	if _, _, err := ac.db.CreateNotification(ctx, userId, notificationType, actorId, chirpId); err != nil {
+		slog.ErrorContext(ctx, "Couldn't notify user", "user_id", userId, "type", notificationType, "err", err)
+	}
+}
+
+// notifyChirp sends the reply and mention notifications for a new chirp.
+func (ac *apiConfig) notifyChirp(ctx context.Context, chirp database.Chirp) {
+	notified := []int{}
+	if chirp.ReplyTo != 0 {
+		parent, err := ac.db.GetChirp(ctx, chirp.ReplyTo)
+		if err == nil {
+			ac.notify(ctx, parent.UserId, database.NotificationReply, chirp.UserId, chirp.Id)
+			notified = append(notified, parent.UserId)
+		}
+	}
+	for _, match := range mentionRe.FindAllStringSubmatch(chirp.Body, -1) {
+		user, err := ac.db.FindUserByEmail(ctx, match[1])
+		if err != nil || slices.Contains(notified, user.Id) {
+			continue
+		}
+		ac.notify(ctx, user.Id, database.NotificationMention, chirp.UserId, chirp.Id)
+		notified = append(notified, user.Id)
+	}
+}
+
+func (ac *apiConfig) getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	query := r.URL.Query()
+	unreadOnly := query.Get("unread") == "true"
+	v := validation.Validator{}
+	limit := queryInt(&v, query, "limit", defaultNotificationsLimit)
+	before := queryInt(&v, query, "before", 0)
+	if limit < 1 {
+		v.AddError("limit", validation.CodeInvalidFormat)
+	}
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	notifications, unread, err := ac.db.GetNotifications(r.Context(), user.Id, unreadOnly, before, min(limit, maxNotificationsLimit))
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(notificationsResponse{UnreadCount: unread, Notifications: notifications}, http.StatusOK, w, r)
+}
+
+// queryInt parses the non-negative integer query parameter name, returning
+// def if it's missing.
+func queryInt(v *validation.Validator, query url.Values, name string, def int) int {
+	value := query.Get(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		v.AddError(name, validation.CodeInvalidFormat)
+		return def
+	}
+	return n
+}
+
+// postNotificationsReadHandler marks the notifications in ids as read, or
+// all of them when ids is empty.
+func (ac *apiConfig) postNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	body := markReadBody{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	if err := ac.db.MarkNotificationsRead(r.Context(), user.Id, body.Ids); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ac *apiConfig) getNotificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	sendResponse(notificationPrefs(user), http.StatusOK, w, r)
+}
+
+// putNotificationPrefsHandler takes a map of notification type to whether
+// it's enabled. Types left out keep their current setting.
+func (ac *apiConfig) putNotificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	prefs := map[string]bool{}
+	if err := decodeJSONBody(w, r, &prefs); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	v := validation.Validator{}
+	for notificationType := range prefs {
+		if !slices.Contains(database.NotificationTypes, notificationType) {
+			v.AddError(notificationType, validation.CodeUnknownField)
+		}
+	}
+	if err := v.Err(); err != nil {
+		handleErr(err, w, r)
+		return
+	}
+
+	if user.NotificationPrefs == nil {
+		user.NotificationPrefs = make(map[string]bool)
+	}
+	for notificationType, enabled := range prefs {
+		user.NotificationPrefs[notificationType] = enabled
+	}
+	user, err := ac.db.CompareAndSwapUser(r.Context(), user, user.Version)
+	if err != nil {
+		handleErr(err, w, r)
+		return
+	}
+	sendResponse(notificationPrefs(user), http.StatusOK, w, r)
+}
+
+// notificationPrefs lists every notification type with its setting.
+func notificationPrefs(user database.User) map[string]bool {
+	prefs := make(map[string]bool, len(database.NotificationTypes))
+	for _, notificationType := range database.NotificationTypes {
+		enabled, ok := user.NotificationPrefs[notificationType]
+		prefs[notificationType] = !ok || enabled
+	}
+	return prefs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+func TestGetNotificationsHandlerPages(t *testing.T) {
+	ac := newTestAPI(t)
+	ctx := context.Background()
+	user, err := ac.db.CreateUser(ctx, "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Notifications 1 to 5, with 2 read.
+	for chirpId := 1; chirpId <= 5; chirpId++ {
+		if _, _, err := ac.db.CreateNotification(ctx, user.Id, database.NotificationLike, 2, chirpId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ac.db.MarkNotificationsRead(ctx, user.Id, []int{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantIds    []int
+	}{
+		{"", http.StatusOK, []int{5, 4, 3, 2, 1}},
+		{"?limit=2", http.StatusOK, []int{5, 4}},
+		{"?limit=2&before=4", http.StatusOK, []int{3, 2}},
+		{"?limit=2&before=2", http.StatusOK, []int{1}},
+		{"?before=1", http.StatusOK, []int{}},
+		{"?unread=true&before=4", http.StatusOK, []int{3, 1}},
+		{"?limit=1000", http.StatusOK, []int{5, 4, 3, 2, 1}},
+		{"?limit=0", http.StatusBadRequest, nil},
+		{"?limit=ten", http.StatusBadRequest, nil},
+		{"?before=-1", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/notifications"+tt.query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+		w := httptest.NewRecorder()
+		ac.getNotificationsHandler(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		resp := notificationsResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, notification := range resp.Notifications {
+			ids = append(ids, notification.Id)
+		}
+		if !reflect.DeepEqual(ids, tt.wantIds) || resp.UnreadCount != 4 {
+			t.Errorf("%s: ids %v with %d unread, want %v with 4", tt.query, ids, resp.UnreadCount, tt.wantIds)
+		}
+	}
+}
+
+func TestGetNotificationsHandlerCapsLimit(t *testing.T) {
+	ac := newTestAPI(t)
+	ctx := context.Background()
+	user, err := ac.db.CreateUser(ctx, "jo@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for chirpId := 1; chirpId <= maxNotificationsLimit+1; chirpId++ {
+		if _, _, err := ac.db.CreateNotification(ctx, user.Id, database.NotificationLike, 2, chirpId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/notifications?limit=1000", nil)
+	req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	ac.getNotificationsHandler(w, req)
+	resp := notificationsResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Notifications) != maxNotificationsLimit {
+		t.Errorf("got %d notifications, want %d", len(resp.Notifications), maxNotificationsLimit)
+	}
+}
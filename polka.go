@@ -1,11 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+
+	"github.com/petomackay/chirpy/internal/database"
 )
 
 type webhookParams struct {
@@ -16,8 +19,8 @@ type webhookParams struct {
 }
 
 func (ac *apiConfig) handleWebhooks(w http.ResponseWriter, r *http.Request) {
-	if err := authenticatePolka(ac.polkaApiKey, r); err != nil {
-		log.Printf("Couldn't authenticate polka webhook request: %s", err)
+	if err := authenticateApiKey(ac.polkaApiKey, r); err != nil {
+		slog.WarnContext(r.Context(), "Couldn't authenticate polka webhook request", "err", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -25,8 +28,8 @@ func (ac *apiConfig) handleWebhooks(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	params := webhookParams{}
 	if err := decoder.Decode(&params); err != nil {
-		log.Println("Couldn't decode polka webhook body" + err.Error())
-		handleError("Oops", http.StatusBadRequest, w)
+		slog.WarnContext(r.Context(), "Couldn't decode polka webhook body", "err", err)
+		handleError(errBadRequest, w, r)
 		return
 	}
 
@@ -35,17 +38,13 @@ func (ac *apiConfig) handleWebhooks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := ac.db.FindUserById(params.Data.UserId)
-	if err != nil {
-		log.Printf("Couldn't find user with ID %d in polka webhook: %v\n", params.Data.UserId, err)
-		handleError("Not found", http.StatusNotFound, w)
-		return
-	}
-
-	user.ChirpyRed = true
-	if err := ac.db.UpdateUser(user); err != nil {
-		log.Printf("Couldn't upgrade user id:%d to chirpy red in polka webhook: %v\n", params.Data.UserId, err)
-		handleError("Couldn't upgrade user, soz", http.StatusInternalServerError, w)
+	if _, err := ac.db.SetChirpyRed(r.Context(), params.Data.UserId, true); err != nil {
+		if errors.Is(err, database.ErrNotExist) {
+			slog.WarnContext(r.Context(), "Couldn't find user in polka webhook", "user_id", params.Data.UserId, "err", err)
+		} else {
+			slog.ErrorContext(r.Context(), "Couldn't upgrade user to chirpy red in polka webhook", "user_id", params.Data.UserId, "err", err)
+		}
+		handleErr(err, w, r)
 		return
 	}
 
@@ -53,15 +52,18 @@ func (ac *apiConfig) handleWebhooks(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func authenticatePolka(expectedApiKey string, r *http.Request) error {
+func authenticateApiKey(expectedApiKey string, r *http.Request) error {
+	if expectedApiKey == "" {
+		return errors.New("No ApiKey configured")
+	}
 	apiKey, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey")
 	if !found {
-		log.Println("Couldn't find an ApiKey in the polka webhook request.")
 		return errors.New("Couldn't find ApiKey")
 	}
 	apiKey = strings.TrimSpace(apiKey)
-	if apiKey != expectedApiKey {
-		log.Printf("Polka ApiKey doesn't match: %s\n", apiKey)
+	// Constant time, so response times don't leak how much of the key
+	// matched.
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(expectedApiKey)) != 1 {
 		return errors.New("Wrong ApiKey")
 	}
 
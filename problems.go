@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+// apiError is an error the API reports to clients. Code is stable and meant
+// for machines; Title is the human readable summary.
+type apiError struct {
+	Status int
+	Code   string
+	Title  string
+}
+
+var (
+	errBadRequest           = apiError{http.StatusBadRequest, "bad_request", "The request is malformed."}
+	errValidation           = apiError{http.StatusBadRequest, "validation_failed", "The request contains invalid fields."}
+	errInvalidToken         = apiError{http.StatusBadRequest, "invalid_token", "The token is invalid, expired or already used."}
+	errChirpTooLong         = apiError{http.StatusBadRequest, "chirp_too_long", "The chirp is too long."}
+	errUnauthorized         = apiError{http.StatusUnauthorized, "unauthorized", "Valid credentials are required."}
+	errInvalidCredentials   = apiError{http.StatusUnauthorized, "invalid_credentials", "The email or password is incorrect."}
+	errInvalidTwoFactorCode = apiError{http.StatusUnauthorized, "invalid_two_factor_code", "The two-factor code is incorrect."}
+	errForbidden            = apiError{http.StatusForbidden, "forbidden", "You're not allowed to do that."}
+	errNotFound             = apiError{http.StatusNotFound, "not_found", "The resource doesn't exist."}
+	errConflict             = apiError{http.StatusConflict, "conflict", "The resource already exists."}
+	errPreconditionFailed   = apiError{http.StatusPreconditionFailed, "precondition_failed", "The resource has changed since you last read it."}
+	errPreconditionRequired = apiError{http.StatusPreconditionRequired, "precondition_required", "Send the ETag you last read in If-Match."}
+	errDeliveryNotDead      = apiError{http.StatusConflict, "delivery_not_dead", "Only dead deliveries can be retried."}
+	errEditConflict         = apiError{http.StatusConflict, "edit_conflict", "The resource was changed by another request, try again."}
+	errTwoFactorEnabled     = apiError{http.StatusConflict, "two_factor_already_enabled", "Two-factor authentication is already enabled."}
+	errTwoFactorNotPending  = apiError{http.StatusConflict, "two_factor_not_pending", "There's no two-factor enrolment to confirm."}
+	errTooManyRequests      = apiError{http.StatusTooManyRequests, "too_many_requests", "Too many requests, slow down."}
+	errTooManyLogins        = apiError{http.StatusTooManyRequests, "too_many_login_attempts", "Too many login attempts, try again later."}
+	errInternal             = apiError{http.StatusInternalServerError, "internal_error", "Something went wrong on our side."}
+)
+
+// problemDetails is an RFC 9457 problem, extended with our error code, the
+// request ID and any field errors.
+type problemDetails struct {
+	Type      string                  `json:"type"`
+	Title     string                  `json:"title"`
+	Status    int                     `json:"status"`
+	Code      string                  `json:"code"`
+	Instance  string                  `json:"instance,omitempty"`
+	RequestId string                  `json:"request_id,omitempty"`
+	Errors    []validation.FieldError `json:"errors,omitempty"`
+}
+
+func newProblem(apiErr apiError, r *http.Request) problemDetails {
+	p := problemDetails{
+		Type:   "urn:chirpy:problem:" + apiErr.Code,
+		Title:  apiErr.Title,
+		Status: apiErr.Status,
+		Code:   apiErr.Code,
+	}
+	if r != nil {
+		p.Instance = r.URL.Path
+		p.RequestId = middleware.GetReqID(r.Context())
+	}
+	return p
+}
+
+func handleError(apiErr apiError, w http.ResponseWriter, r *http.Request) {
+	writeProblem(newProblem(apiErr, r), w)
+}
+
+// handleErr is the single place mapping internal errors to responses. The
+// error itself is only logged, never sent to the client.
+func handleErr(err error, w http.ResponseWriter, r *http.Request) {
+	var validationErrs validation.Errors
+	switch {
+	case errors.As(err, &validationErrs):
+		p := newProblem(errValidation, r)
+		p.Errors = validationErrs.Errors
+		writeProblem(p, w)
+	case errors.Is(err, database.ErrNotExist):
+		handleError(errNotFound, w, r)
+	case errors.Is(err, database.ErrAlreadyExists):
+		handleError(errConflict, w, r)
+	case errors.Is(err, database.ErrVersionMismatch):
+		handleError(errPreconditionFailed, w, r)
+	default:
+		slog.ErrorContext(r.Context(), "Internal error", "method", r.Method, "path", r.URL.Path, "err", err)
+		handleError(errInternal, w, r)
+	}
+}
+
+// handleUserSwapErr reports a failed CompareAndSwapUser of a request without
+// If-Match: the user changed between reading and writing it, which is a
+// conflict rather than a failed precondition.
+func handleUserSwapErr(err error, w http.ResponseWriter, r *http.Request) {
+	if errors.Is(err, database.ErrVersionMismatch) {
+		handleError(errEditConflict, w, r)
+		return
+	}
+	handleErr(err, w, r)
+}
+
+func writeProblem(p problemDetails, w http.ResponseWriter) {
+	dat, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("Couldn't marshal problem details", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(dat)
+}
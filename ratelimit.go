@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPolicy describes a token bucket: Limit requests are allowed in a
+// burst and the bucket refills at Limit tokens per Period.
+type rateLimitPolicy struct {
+	Name     string
+	Limit    int
+	RedLimit int
+	Period   time.Duration
+	Key      func(r *http.Request) string
+}
+
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// rateLimitStore keeps the token buckets. The in-memory store works for a
+// single instance; a shared backend only has to implement Take.
+type rateLimitStore interface {
+	Take(key string, limit int, period time.Duration, now time.Time) (rateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	fullAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	mux       *sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+const rateLimitSweepInterval = time.Minute
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		mux:     &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit int, period time.Duration, now time.Time) (rateLimitResult, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.sweep(now)
+
+	capacity := float64(limit)
+	rate := capacity / period.Seconds()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[key] = bucket
+	}
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(capacity, bucket.tokens+elapsed*rate)
+	bucket.last = now
+
+	result := rateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsToDuration((capacity - bucket.tokens) / rate)
+	bucket.fullAt = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep drops buckets that have refilled completely, since they carry no
+// state a fresh bucket wouldn't have.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if !now.Before(bucket.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (ac *apiConfig) middlewareRateLimit(policy rateLimitPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := policy.Limit
+			if user, ok := userFromContext(r.Context()); ok && user.ChirpyRed && policy.RedLimit > 0 {
+				limit = policy.RedLimit
+			}
+
+			key := policy.Name + ":" + policy.Key(r)
+			result, err := ac.rateLimiter.Take(key, limit, policy.Period, time.Now())
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Couldn't check rate limit", "rate_limit_key", key, "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				sendTooManyRequests(result.RetryAfter, errTooManyRequests, w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitByUser keys on the authenticated user and falls back to the
+// client IP for anonymous requests.
+func rateLimitByUser(r *http.Request) string {
+	if user, ok := userFromContext(r.Context()); ok {
+		return "user:" + strconv.Itoa(user.Id)
+	}
+	return rateLimitByIP(r)
+}
+
+func rateLimitByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func sendTooManyRequests(retryAfter time.Duration, apiErr apiError, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(retryAfter), 1)))
+	handleError(apiErr, w, r)
+}
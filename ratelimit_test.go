@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+)
+
+func TestMemoryRateLimitStoreRefills(t *testing.T) {
+	// 4 requests per 4 seconds: a burst of 4, then one token a second.
+	const limit = 4
+	const period = 4 * time.Second
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// at is the time of the request, relative to start.
+		at            time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantRetry     time.Duration
+	}{
+		{"burst 1", 0, true, 3, 0},
+		{"burst 2", 0, true, 2, 0},
+		{"burst 3", 0, true, 1, 0},
+		{"burst 4", 0, true, 0, 0},
+		{"empty", 0, false, 0, time.Second},
+		{"partly refilled", 500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{"one token back", time.Second, true, 0, 0},
+		{"empty again", time.Second, false, 0, time.Second},
+		{"two tokens back", 3 * time.Second, true, 1, 0},
+		{"capped at the limit", time.Hour, true, limit - 1, 0},
+	}
+
+	store := newMemoryRateLimitStore()
+	for _, tt := range tests {
+		result, err := store.Take("key", limit, period, start.Add(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != tt.wantAllowed || result.Remaining != tt.wantRemaining || result.RetryAfter != tt.wantRetry {
+			t.Errorf("%s: Take = %+v, want allowed %v, %d remaining, retry after %s", tt.name, result, tt.wantAllowed, tt.wantRemaining, tt.wantRetry)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreKeysAreSeparate(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	now := time.Now()
+	if result, _ := store.Take("a", 1, time.Minute, now); !result.Allowed {
+		t.Fatal("first request of a was refused")
+	}
+	if result, _ := store.Take("a", 1, time.Minute, now); result.Allowed {
+		t.Error("second request of a was allowed")
+	}
+	if result, _ := store.Take("b", 1, time.Minute, now); !result.Allowed {
+		t.Error("b was limited by a's requests")
+	}
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	policy := rateLimitPolicy{
+		Name:     "test",
+		Limit:    2,
+		RedLimit: 4,
+		Period:   time.Minute,
+		Key:      rateLimitByUser,
+	}
+	tests := []struct {
+		name  string
+		user  *database.User
+		limit int
+	}{
+		{"anonymous", nil, 2},
+		{"user", &database.User{Id: 1}, 2},
+		{"chirpy red", &database.User{Id: 2, ChirpyRed: true}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := newTestAPI(t)
+			handler := ac.middlewareRateLimit(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			request := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.user != nil {
+					req = req.WithContext(context.WithValue(req.Context(), userContextKey, *tt.user))
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			for i := 0; i < tt.limit; i++ {
+				w := request()
+				if w.Code != http.StatusNoContent {
+					t.Fatalf("request %d: status %d, want 204", i+1, w.Code)
+				}
+				if got, want := w.Header().Get("X-RateLimit-Remaining"), tt.limit-i-1; got != strconv.Itoa(want) {
+					t.Errorf("request %d: X-RateLimit-Remaining = %s, want %d", i+1, got, want)
+				}
+			}
+			w := request()
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("request over the limit: status %d, want 429", w.Code)
+			}
+			if w.Header().Get("Retry-After") == "" || w.Header().Get("X-RateLimit-Limit") != strconv.Itoa(tt.limit) {
+				t.Errorf("headers = %v, want Retry-After and X-RateLimit-Limit %d", w.Header(), tt.limit)
+			}
+		})
+	}
+}
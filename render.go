@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+
+	// Responses smaller than this aren't worth compressing.
+	minCompressBytes = 1024
+)
+
+type encoder struct {
+	contentType string
+	marshal     func(v interface{}) ([]byte, error)
+}
+
+var encoders = []encoder{
+	{contentType: contentTypeJSON, marshal: json.Marshal},
+	{contentType: contentTypeCBOR, marshal: cbor.Marshal},
+}
+
+// sendResponse encodes data in the format the client asked for, tags GET
+// responses with an ETag and compresses large bodies. Handlers may set their
+// own ETag beforehand, otherwise one is derived from the body.
+func sendResponse(data interface{}, statusCode int, w http.ResponseWriter, r *http.Request) {
+	enc := negotiateEncoder(r.Header.Get("Accept"))
+	dat, err := enc.marshal(data)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't marshal response", "content_type", enc.contentType, "err", err)
+		writeProblem(newProblem(errInternal, r), w)
+		return
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Accept")
+	header.Add("Vary", "Accept-Encoding")
+	contentType := enc.contentType
+	if contentType == contentTypeJSON {
+		contentType += "; charset=utf-8"
+	}
+	header.Set("Content-Type", contentType)
+
+	if statusCode == http.StatusOK && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		etag := header.Get("ETag")
+		if etag == "" {
+			etag = weakETag(enc.contentType, dat)
+			header.Set("ETag", etag)
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if len(dat) >= minCompressBytes {
+		if encoding := negotiateCompression(r.Header.Get("Accept-Encoding")); encoding != "" {
+			compressed, err := compress(encoding, dat)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Couldn't compress response", "encoding", encoding, "err", err)
+			} else {
+				header.Set("Content-Encoding", encoding)
+				dat = compressed
+			}
+		}
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(dat)))
+	w.WriteHeader(statusCode)
+	if r.Method != http.MethodHead {
+		w.Write(dat)
+	}
+}
+
+// The ETag is weak because it's computed before compression, so the same
+// tag covers every content encoding of the representation.
+func weakETag(contentType string, dat []byte) string {
+	h := sha256.New()
+	h.Write([]byte(contentType))
+	h.Write(dat)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+type acceptedValue struct {
+	value string
+	q     float64
+}
+
+// parseAccept parses an Accept style header into its values ordered by
+// preference. Values with q=0 are dropped.
+func parseAccept(header string) []acceptedValue {
+	values := []acceptedValue{}
+	for _, part := range strings.Split(header, ",") {
+		value, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			// Accept-Encoding values like "gzip" aren't media types.
+			value, _, _ = strings.Cut(strings.TrimSpace(part), ";")
+			params = map[string]string{}
+			if _, q, found := strings.Cut(part, "q="); found {
+				params["q"] = strings.TrimSpace(q)
+			}
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+		if value != "" && q > 0 {
+			values = append(values, acceptedValue{value: strings.ToLower(value), q: q})
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+	return values
+}
+
+// negotiateEncoder picks the preferred supported format, falling back to
+// JSON when the client doesn't accept any of them.
+func negotiateEncoder(accept string) encoder {
+	for _, accepted := range parseAccept(accept) {
+		for _, enc := range encoders {
+			if accepted.value == enc.contentType {
+				return enc
+			}
+		}
+	}
+	return encoders[0]
+}
+
+func negotiateCompression(acceptEncoding string) string {
+	for _, accepted := range parseAccept(acceptEncoding) {
+		switch accepted.value {
+		case "br", "gzip":
+			return accepted.value
+		case "*":
+			return "gzip"
+		}
+	}
+	return ""
+}
+
+func compress(encoding string, dat []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	var cw io.WriteCloser
+	switch encoding {
+	case "br":
+		cw = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	default:
+		cw = gzip.NewWriter(&buf)
+	}
+	if _, err := cw.Write(dat); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
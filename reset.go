@@ -1,13 +0,0 @@
-package main
-
-import (
-	"net/http"
-)
-
-func (cfg *apiConfig) resetCallback(w http.ResponseWriter, r *http.Request) {
-	cfg.fileserverHits = 0
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
-	return
-}
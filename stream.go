@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/pubsub"
+	"github.com/petomackay/chirpy/internal/validation"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	streamQueueSize         = 64
+)
+
+// streamHandler pushes chirp events as Server-Sent Events. Clients can
+// filter by author_id and resume with Last-Event-ID. If the events they
+// missed are no longer buffered, they get a "resync" event and should
+// refetch /api/chirps.
+func (ac *apiConfig) streamHandler(w http.ResponseWriter, r *http.Request) {
+	authorId := 0
+	if author := r.URL.Query().Get("author_id"); author != "" {
+		id, err := strconv.Atoi(author)
+		if err != nil {
+			handleErr(validation.NewErrors("author_id", validation.CodeInvalidFormat), w, r)
+			return
+		}
+		authorId = id
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+	var lastId uint64
+	if lastEventId != "" {
+		id, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			handleErr(validation.NewErrors("Last-Event-ID", validation.CodeInvalidFormat), w, r)
+			return
+		}
+		lastId = id
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleErr(fmt.Errorf("response writer doesn't support flushing"), w, r)
+		return
+	}
+
+	sub, backlog, complete := ac.db.Events().Subscribe(lastId, streamQueueSize)
+	defer sub.Close()
+	clearDeadlines(w)
+	streams := ac.metrics.openStreams.WithLabelValues("sse")
+	streams.Inc()
+	defer streams.Dec()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		if err := writeStreamEvent(w, event, authorId); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ac.shutdown:
+			// Clients reconnect with their Last-Event-ID, hopefully to
+			// another instance.
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				// Dropped for being too slow, the client will reconnect
+				// with its Last-Event-ID.
+				return
+			}
+			if err := writeStreamEvent(w, event, authorId); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event pubsub.Event, authorId int) error {
+	chirp, ok := event.Data.(database.Chirp)
+	if !ok || (authorId != 0 && chirp.UserId != authorId) {
+		return nil
+	}
+	dat, err := json.Marshal(chirp)
+	if err != nil {
+		slog.Error("Couldn't marshal stream event", "event_id", event.Id, "err", err)
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, dat)
+	return err
+}
@@ -1,63 +1,83 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/petomackay/chirpy/internal/database"
 )
 
-const accessTokenExpirationTime int = 60 * 60
-const refreshtokenExpirationTime int = 60 * 60 * 60
+const accessTokenIssuer = "chirpy-access"
+const refreshTokenIssuer = "chirpy-refresh"
+const challengeTokenIssuer = "chirpy-2fa"
 
-func issueAccessToken(userId string, jwtSecret []byte) (string, error) {
-	currentTime := time.Now()
+// userClaims are the claims of the tokens issued to a user. Generation is
+// the user's token generation at the time, see revokeUserTokens.
+type userClaims struct {
+	Generation int `json:"gen,omitempty"`
+	jwt.RegisteredClaims
+}
 
-	log.Printf("Issuing a new token for user with ID: %s\n", userId)
+func issueUserToken(user database.User, issuer string, expiration time.Duration, jwtSecret []byte) (string, error) {
+	currentTime := time.Now()
 
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		IssuedAt:  jwt.NewNumericDate(currentTime),
-		ExpiresAt: jwt.NewNumericDate(currentTime.Add(time.Duration(accessTokenExpirationTime) * time.Second)),
-		Subject:   userId,
+	claims := userClaims{
+		Generation: user.TokenGeneration,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			IssuedAt:  jwt.NewNumericDate(currentTime),
+			ExpiresAt: jwt.NewNumericDate(currentTime.Add(expiration)),
+			Subject:   strconv.Itoa(user.Id),
+		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
 
-func issueRefreshToken(userId string, jwtSecret []byte) (string, error) {
-	currentTime := time.Now()
+func issueAccessToken(user database.User, expiration time.Duration, jwtSecret []byte) (string, error) {
+	return issueUserToken(user, accessTokenIssuer, expiration, jwtSecret)
+}
 
-	log.Printf("Issuing a new refresh token for user with ID: %s\n", userId)
+func issueRefreshToken(user database.User, expiration time.Duration, jwtSecret []byte) (string, error) {
+	return issueUserToken(user, refreshTokenIssuer, expiration, jwtSecret)
+}
 
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy-refresh",
-		IssuedAt:  jwt.NewNumericDate(currentTime),
-		ExpiresAt: jwt.NewNumericDate(currentTime.Add(time.Duration(refreshtokenExpirationTime) * time.Second)),
-		Subject:   userId,
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+// issueChallengeToken issues a short-lived token proving that the user got
+// past the password check but still has to provide a second factor.
+func issueChallengeToken(user database.User, expiration time.Duration, jwtSecret []byte) (string, error) {
+	return issueUserToken(user, challengeTokenIssuer, expiration, jwtSecret)
 }
 
-func extractClaims(tokenString string, jwtSecret []byte) (jwt.Claims, error) {
-	claims := jwt.RegisteredClaims{}
+func extractClaims(tokenString string, jwtSecret []byte) (userClaims, error) {
+	claims := userClaims{}
 	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
 	})
 	if err != nil {
-		log.Println("Couldn't parse JWT: " + err.Error())
-		log.Println("the token was:'" + tokenString + "'")
-		return nil, err
+		slog.Debug("Couldn't parse JWT", "err", err)
+		return userClaims{}, err
 	}
-	log.Printf("the id from claims was: %s\n", claims.Subject)
 	return claims, nil
 }
 
 func isAccessToken(tokenString string, jwtSecret []byte) bool {
+	return hasIssuer(tokenString, jwtSecret, accessTokenIssuer)
+}
+
+func isRefreshToken(tokenString string, jwtSecret []byte) bool {
+	return hasIssuer(tokenString, jwtSecret, refreshTokenIssuer)
+}
+
+func isChallengeToken(tokenString string, jwtSecret []byte) bool {
+	return hasIssuer(tokenString, jwtSecret, challengeTokenIssuer)
+}
+
+func hasIssuer(tokenString string, jwtSecret []byte, expectedIssuer string) bool {
 	claims, err := extractClaims(tokenString, jwtSecret)
 	if err != nil {
 		return false
@@ -66,7 +86,7 @@ func isAccessToken(tokenString string, jwtSecret []byte) bool {
 	if err != nil {
 		return false
 	}
-	return issuer == "chirpy-access"
+	return issuer == expectedIssuer
 }
 
 func getIdFromToken(tokenString string, jwtSecret []byte) (int, error) {
@@ -82,30 +102,61 @@ func getIdFromToken(tokenString string, jwtSecret []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	log.Printf("id: %d\n", id)
 	return id, nil
 }
 
-func (ac *apiConfig) handleRefresh(w http.ResponseWriter, r *http.Request) {
-	tokenString, found := extractTokenString(r)
+// revokeUserTokens makes the tokens issued to user so far invalid, e.g.
+// after a password reset, by moving the user to the next token generation.
+// Unlike issue times, generations can't tie, so a token minted just before
+// the revocation can't slip through.
+func revokeUserTokens(user *database.User) {
+	user.TokenGeneration++
+}
 
-	if found {
-		log.Println("FOUND")
+// issuedBeforeRevocation reports whether tokenString was issued before the
+// tokens of user were last revoked. Tokens without a generation are from
+// generation 0.
+func issuedBeforeRevocation(user database.User, tokenString string, jwtSecret []byte) bool {
+	claims, err := extractClaims(tokenString, jwtSecret)
+	if err != nil {
+		return true
 	}
+	return claims.Generation < user.TokenGeneration
+}
 
-	log.Println("The token string:" + tokenString)
+func getExpiryFromToken(tokenString string, jwtSecret []byte) (time.Time, error) {
+	claims, err := extractClaims(tokenString, jwtSecret)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expiresAt == nil {
+		return time.Time{}, errors.New("Token has no expiry")
+	}
+	return expiresAt.Time, nil
+}
 
-	if !found || isAccessToken(tokenString, []byte(ac.jwtSecret)) || ac.db.IsTokenRevoked(tokenString) {
-		handleError("Auth error", http.StatusUnauthorized, w)
+func (ac *apiConfig) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	tokenString, found := extractTokenString(r)
+	if !found || !isRefreshToken(tokenString, []byte(ac.jwtSecret)) || ac.db.IsTokenRevoked(r.Context(), tokenString) {
+		handleError(errUnauthorized, w, r)
 		return
 	}
 	id, _ := getIdFromToken(tokenString, []byte(ac.jwtSecret))
-	accessToken, err := issueAccessToken(strconv.Itoa(id), []byte(ac.jwtSecret))
+	user, err := ac.db.FindUserById(r.Context(), id)
+	if err != nil || issuedBeforeRevocation(user, tokenString, []byte(ac.jwtSecret)) {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	accessToken, err := issueAccessToken(user, ac.config.Tokens.AccessTTL, []byte(ac.jwtSecret))
 	if err != nil {
-		handleError("Oops", http.StatusInternalServerError, w)
+		handleErr(err, w, r)
 		return
 	}
-	sendJson(userLoginResponse{Token: accessToken}, http.StatusOK, w)
+	sendResponse(userLoginResponse{Token: accessToken}, http.StatusOK, w, r)
 }
 
 func (ac *apiConfig) handleRevoke(w http.ResponseWriter, r *http.Request) {
@@ -115,12 +166,14 @@ func (ac *apiConfig) handleRevoke(w http.ResponseWriter, r *http.Request) {
 		return []byte(ac.jwtSecret), nil
 	})
 	if err != nil || !found {
-		handleError("Unauthorized", http.StatusUnauthorized, w)
+		handleError(errUnauthorized, w, r)
+		return
 	}
 
-	err = ac.db.RevokeToken(tokenString)
+	err = ac.db.RevokeToken(r.Context(), tokenString)
 	if err != nil {
-		handleError("Couldn't revoke token", http.StatusInternalServerError, w)
+		handleErr(err, w, r)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	return
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+	"github.com/petomackay/chirpy/internal/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	webhookTimeout        = 10 * time.Second
+	webhookMaxAttempts    = 8
+	webhookBackoffBase    = 30 * time.Second
+	webhookBackoffMax     = time.Hour
+	webhookSubscriberSize = 256
+)
+
+var webhookEvents = []string{
+	database.EventChirpCreated,
+	database.EventChirpUpdated,
+	database.EventChirpDeleted,
+	database.EventChirpLiked,
+}
+
+type webhookPayload struct {
+	Event     string      `json:"event"`
+	EventId   uint64      `json:"event_id"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// runWebhookDispatcher queues a delivery for every chirp event the owner of
+// the chirp has a webhook for.
+func (ac *apiConfig) runWebhookDispatcher(ctx context.Context) {
+	var lastId uint64
+	for {
+		sub, backlog, _ := ac.db.Events().Subscribe(lastId, webhookSubscriberSize)
+		for _, event := range backlog {
+			ac.dispatchWebhookEvent(ctx, event)
+			lastId = event.Id
+		}
+
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+				return
+			case event, ok := <-sub.C:
+				if !ok {
+					// Dropped for falling behind, resubscribe and catch
+					// up from the hub's buffer.
+					break events
+				}
+				ac.dispatchWebhookEvent(ctx, event)
+				lastId = event.Id
+			}
+		}
+	}
+}
+
+func (ac *apiConfig) dispatchWebhookEvent(ctx context.Context, event pubsub.Event) {
+	ownerId := 0
+	switch data := event.Data.(type) {
+	case database.Chirp:
+		ownerId = data.UserId
+	case database.Like:
+		ownerId = data.AuthorId
+	default:
+		return
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		Event:     event.Type,
+		EventId:   event.Id,
+		CreatedAt: time.Now().UnixMilli(),
+		Data:      event.Data,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't marshal webhook payload", "event_id", event.Id, "err", err)
+		return
+	}
+	deliveries, err := ac.db.EnqueueWebhookDeliveries(ctx, ownerId, event.Type, string(payload))
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't record webhook deliveries", "event_id", event.Id, "err", err)
+		return
+	}
+	for _, delivery := range deliveries {
+		ac.enqueueWebhookDelivery(ctx, delivery)
+	}
+}
+
+type webhookJobPayload struct {
+	DeliveryId int `json:"delivery_id"`
+}
+
+func (ac *apiConfig) enqueueWebhookDelivery(ctx context.Context, delivery database.WebhookDelivery) {
+	if _, err := ac.jobs.Enqueue(jobDeliverWebhook, webhookJobPayload{DeliveryId: delivery.Id}); err != nil {
+		slog.ErrorContext(ctx, "Couldn't queue webhook delivery", "delivery_id", delivery.Id, "err", err)
+	}
+}
+
+// deliverWebhookJob makes one attempt at a delivery and records the outcome
+// in the delivery log. Failures are retried by the job queue.
+func (ac *apiConfig) deliverWebhookJob(ctx context.Context, job jobs.Job) error {
+	payload := webhookJobPayload{}
+	if err := job.Decode(&payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	delivery, err := ac.db.GetWebhookDelivery(ctx, payload.DeliveryId)
+	if errors.Is(err, database.ErrNotExist) {
+		// The webhook was deleted along with its deliveries.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	webhook, err := ac.db.GetWebhookById(ctx, delivery.WebhookId)
+	if errors.Is(err, database.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	statusCode, sendErr := sendWebhook(ctx, ac.webhookClient, webhook, delivery, now)
+	delivery.LastStatusCode = statusCode
+	if sendErr == nil {
+		delivery.Status = database.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = now.UnixMilli()
+	} else {
+		delivery.LastError = sendErr.Error()
+		if job.LastAttempt() {
+			delivery.Status = database.DeliveryDead
+		} else {
+			delivery.NextAttemptAt = now.Add(webhookBackoff(job.Attempts)).UnixMilli()
+		}
+	}
+
+	if err := ac.db.UpdateWebhookDelivery(ctx, delivery); err != nil && !errors.Is(err, database.ErrNotExist) {
+		slog.ErrorContext(ctx, "Couldn't update webhook delivery", "delivery_id", delivery.Id, "err", err)
+	}
+	return sendErr
+}
+
+// interruptedWebhookJob moves the delivery of a job that died in a crash to
+// the dead letter list, where deliverWebhookJob would have put it.
+func (ac *apiConfig) interruptedWebhookJob(ctx context.Context, job jobs.Job) {
+	payload := webhookJobPayload{}
+	if err := job.Decode(&payload); err != nil {
+		return
+	}
+	delivery, err := ac.db.GetWebhookDelivery(ctx, payload.DeliveryId)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotExist) {
+			slog.ErrorContext(ctx, "Couldn't get the delivery of an interrupted job", "delivery_id", payload.DeliveryId, "err", err)
+		}
+		return
+	}
+	if delivery.Status != database.DeliveryPending {
+		return
+	}
+	delivery.Attempts++
+	delivery.Status = database.DeliveryDead
+	delivery.LastError = job.LastError
+	if err := ac.db.UpdateWebhookDelivery(ctx, delivery); err != nil && !errors.Is(err, database.ErrNotExist) {
+		slog.ErrorContext(ctx, "Couldn't update webhook delivery", "delivery_id", delivery.Id, "err", err)
+	}
+}
+
+// errWebhookAddress is returned for receivers on addresses webhooks can't be
+// delivered to.
+var errWebhookAddress = errors.New("webhook address not allowed")
+
+// webhookAddrAllowed reports whether webhooks can be delivered to addr.
+// Loopback, private, link-local and other non-public addresses are refused
+// so webhooks can't be used to reach the server's own network, unless they
+// are in one of the allowed networks.
+func webhookAddrAllowed(addr netip.Addr, allowed []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// newWebhookClient returns the client webhooks are delivered with. The
+// receiver's address is checked when connecting, after the name is
+// resolved, so a public name can't point at a private address. Redirects
+// aren't followed, they would need checking too, and proxies from the
+// environment aren't used.
+func newWebhookClient(allowed []netip.Prefix) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddrAllowed(addrPort.Addr(), allowed) {
+				return fmt.Errorf("%w: %s", errWebhookAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: webhookTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// sendWebhook posts the payload and returns the receiver's status code. Any
+// non-2xx status, redirects included, is an error.
+func sendWebhook(ctx context.Context, client *http.Client, webhook database.Webhook, delivery database.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks/1.0")
+	req.Header.Set("X-Chirpy-Event", delivery.Event)
+	req.Header.Set("X-Chirpy-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("X-Chirpy-Timestamp", timestamp)
+	req.Header.Set("X-Chirpy-Signature", "sha256="+signWebhook(webhook.Secret, timestamp, delivery.Payload))
+	// Lets receivers that trace too join the delivery job's trace.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook signs "<timestamp>.<payload>" so receivers can reject both
+// forged and replayed requests.
+func signWebhook(secret string, timestamp string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var webhookBackoff = jobs.ExponentialBackoff(webhookBackoffBase, webhookBackoffMax)
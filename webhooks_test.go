@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/jobs"
+)
+
+var loopbackNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// newWebhookTest registers a webhook for url and queues a delivery of a
+// chirp.created event to it.
+func newWebhookTest(t *testing.T, url string, allowed []netip.Prefix) (*apiConfig, database.Webhook, database.WebhookDelivery) {
+	t.Helper()
+	ac := newTestAPI(t)
+	ac.webhookNetworks = allowed
+	ac.webhookClient = newWebhookClient(allowed)
+	db := ac.db
+
+	ctx := context.Background()
+	webhook, err := db.CreateWebhook(ctx, 1, url, "secret", []string{database.EventChirpCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := db.EnqueueWebhookDeliveries(ctx, 1, database.EventChirpCreated, `{"event":"chirp.created"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	return ac, webhook, deliveries[0]
+}
+
+func deliveryJob(t *testing.T, delivery database.WebhookDelivery, attempts int) jobs.Job {
+	t.Helper()
+	return jobs.Job{
+		Kind:        jobDeliverWebhook,
+		Payload:     []byte(fmt.Sprintf(`{"delivery_id":%d}`, delivery.Id)),
+		Status:      jobs.StatusRunning,
+		Attempts:    attempts,
+		MaxAttempts: webhookMaxAttempts,
+	}
+}
+
+func TestDeliverWebhookJob(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   string
+	}
+	received := make(chan request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.Header.Clone(), string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	ac, webhook, delivery := newWebhookTest(t, receiver.URL, loopbackNetworks)
+	if err := ac.deliverWebhookJob(context.Background(), deliveryJob(t, delivery, 1)); err != nil {
+		t.Fatalf("deliverWebhookJob: %v", err)
+	}
+
+	req := <-received
+	if req.body != delivery.Payload {
+		t.Errorf("body = %q, want %q", req.body, delivery.Payload)
+	}
+	if got := req.header.Get("X-Chirpy-Event"); got != database.EventChirpCreated {
+		t.Errorf("X-Chirpy-Event = %q, want %q", got, database.EventChirpCreated)
+	}
+	timestamp := req.header.Get("X-Chirpy-Timestamp")
+	want := "sha256=" + signWebhook(webhook.Secret, timestamp, delivery.Payload)
+	if got := req.header.Get("X-Chirpy-Signature"); got != want {
+		t.Errorf("X-Chirpy-Signature = %q, want %q", got, want)
+	}
+
+	stored, err := ac.db.GetWebhookDelivery(context.Background(), delivery.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.DeliveryDelivered || stored.LastStatusCode != http.StatusNoContent || stored.Attempts != 1 {
+		t.Errorf("delivery = %+v, want delivered with 204 after 1 attempt", stored)
+	}
+}
+
+func TestDeliverWebhookJobRetriesAndDies(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	ac, _, delivery := newWebhookTest(t, receiver.URL, loopbackNetworks)
+	ctx := context.Background()
+	if err := ac.deliverWebhookJob(ctx, deliveryJob(t, delivery, 1)); err == nil {
+		t.Fatal("deliverWebhookJob succeeded on a 500")
+	}
+	stored, err := ac.db.GetWebhookDelivery(ctx, delivery.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.DeliveryPending || stored.LastStatusCode != http.StatusInternalServerError || stored.NextAttemptAt <= time.Now().UnixMilli() {
+		t.Errorf("delivery = %+v, want pending with a later attempt", stored)
+	}
+
+	if err := ac.deliverWebhookJob(ctx, deliveryJob(t, delivery, webhookMaxAttempts)); err == nil {
+		t.Fatal("deliverWebhookJob succeeded on a 500")
+	}
+	stored, err = ac.db.GetWebhookDelivery(ctx, delivery.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.DeliveryDead {
+		t.Errorf("status = %q after the last attempt, want %q", stored.Status, database.DeliveryDead)
+	}
+}
+
+func TestInterruptedWebhookJob(t *testing.T) {
+	ac, _, delivery := newWebhookTest(t, "http://192.0.2.1/hook", nil)
+	job := deliveryJob(t, delivery, webhookMaxAttempts)
+	job.Status = jobs.StatusDead
+	job.LastError = "interrupted by a crash"
+	ac.interruptedWebhookJob(context.Background(), job)
+
+	stored, err := ac.db.GetWebhookDelivery(context.Background(), delivery.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.DeliveryDead || stored.LastError != job.LastError {
+		t.Errorf("delivery = %+v, want dead with the job's error", stored)
+	}
+}
+
+func TestDeliverWebhookJobRefusesPrivateAddresses(t *testing.T) {
+	var hits atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer receiver.Close()
+
+	ac, _, delivery := newWebhookTest(t, receiver.URL, nil)
+	err := ac.deliverWebhookJob(context.Background(), deliveryJob(t, delivery, 1))
+	if !errors.Is(err, errWebhookAddress) {
+		t.Errorf("deliverWebhookJob = %v, want %v", err, errWebhookAddress)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the receiver was called %d times", hits.Load())
+	}
+}
+
+func TestSendWebhookDoesNotFollowRedirects(t *testing.T) {
+	var hits atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer receiver.Close()
+
+	ac, webhook, delivery := newWebhookTest(t, receiver.URL, loopbackNetworks)
+	status, err := sendWebhook(context.Background(), ac.webhookClient, webhook, delivery, time.Now())
+	if err == nil || status != http.StatusTemporaryRedirect {
+		t.Errorf("sendWebhook = %d, %v, want 307 and an error", status, err)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("the redirect was followed")
+	}
+}
+
+func TestWebhookAddrAllowed(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed []netip.Prefix
+		want    bool
+	}{
+		{"93.184.216.34", nil, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", nil, true},
+		{"127.0.0.1", nil, false},
+		{"::1", nil, false},
+		{"10.1.2.3", nil, false},
+		{"172.16.0.1", nil, false},
+		{"192.168.1.1", nil, false},
+		{"169.254.169.254", nil, false},
+		{"fe80::1", nil, false},
+		{"fd00::1", nil, false},
+		{"0.0.0.0", nil, false},
+		{"::ffff:127.0.0.1", nil, false},
+		{"127.0.0.1", loopbackNetworks, true},
+		{"::ffff:127.0.0.1", loopbackNetworks, true},
+		{"10.1.2.3", loopbackNetworks, false},
+	}
+	for _, tt := range tests {
+		if got := webhookAddrAllowed(netip.MustParseAddr(tt.addr), tt.allowed); got != tt.want {
+			t.Errorf("webhookAddrAllowed(%s, %v) = %v, want %v", tt.addr, tt.allowed, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/petomackay/chirpy/internal/database"
+	"github.com/petomackay/chirpy/internal/pubsub"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 9 / 10
+	wsMaxMessage   = 4096
+	wsQueueSize    = 64
+
+	// Close codes in the 4000-4999 range are reserved for applications.
+	wsCloseTokenExpired = 4001
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Connections authenticate with a bearer token rather than cookies, so
+	// cross-origin connections can't ride on someone else's session.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsClientMessage is what clients send to manage their subscriptions.
+type wsClientMessage struct {
+	Type     string `json:"type"`
+	AuthorId int    `json:"author_id"`
+}
+
+type wsServerMessage struct {
+	Type     string      `json:"type"`
+	EventId  uint64      `json:"event_id,omitempty"`
+	AuthorId int         `json:"author_id,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type wsClient struct {
+	user    database.User
+	mux     *sync.Mutex
+	authors map[int]struct{}
+}
+
+// wsHandler serves a WebSocket delivering new and deleted chirps of the
+// authors the client subscribed to, plus likes of the user's own chirps and
+// their notifications.
+// The token can be sent in the Authorization header or, since browsers
+// can't set headers on WebSockets, in the token query parameter.
+func (ac *apiConfig) wsHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString, found := extractTokenString(r)
+	if !found {
+		tokenString = r.URL.Query().Get("token")
+	}
+	user, err := ac.authenticateUserWithToken(r.Context(), tokenString)
+	if err != nil {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+	expiresAt, err := getExpiryFromToken(tokenString, []byte(ac.jwtSecret))
+	if err != nil {
+		handleError(errUnauthorized, w, r)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error.
+		slog.WarnContext(r.Context(), "Couldn't upgrade to a websocket", "err", err)
+		return
+	}
+	defer conn.Close()
+	streams := ac.metrics.openStreams.WithLabelValues("ws")
+	streams.Inc()
+	defer streams.Dec()
+
+	sub, _, _ := ac.db.Events().Subscribe(0, wsQueueSize)
+	defer sub.Close()
+
+	client := &wsClient{
+		user:    user,
+		mux:     &sync.Mutex{},
+		authors: make(map[int]struct{}),
+	}
+	replies := make(chan wsServerMessage, wsQueueSize)
+	readDone := make(chan struct{})
+	go client.readLoop(conn, replies, readDone)
+
+	client.writeLoop(conn, sub, replies, readDone, ac.shutdown, time.Until(expiresAt))
+}
+
+func (c *wsClient) readLoop(conn *websocket.Conn, replies chan<- wsServerMessage, done chan<- struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		msg := wsClientMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Info("Websocket closed unexpectedly", "user_id", c.user.Id, "err", err)
+			}
+			return
+		}
+
+		reply := wsServerMessage{Type: msg.Type, AuthorId: msg.AuthorId}
+		c.mux.Lock()
+		switch msg.Type {
+		case "subscribe":
+			c.authors[msg.AuthorId] = struct{}{}
+			reply.Type = "subscribed"
+		case "unsubscribe":
+			delete(c.authors, msg.AuthorId)
+			reply.Type = "unsubscribed"
+		default:
+			reply = wsServerMessage{Type: "error", Error: "unknown message type"}
+		}
+		c.mux.Unlock()
+
+		select {
+		case replies <- reply:
+		default:
+			// The writer is backed up, the client will notice the missing
+			// acknowledgement.
+		}
+	}
+}
+
+func (c *wsClient) writeLoop(conn *websocket.Conn, sub *pubsub.Subscription, replies <-chan wsServerMessage, readDone <-chan struct{}, shutdown <-chan struct{}, untilExpiry time.Duration) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	expiry := time.NewTimer(untilExpiry)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-readDone:
+			return
+		case <-shutdown:
+			c.close(conn, websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-expiry.C:
+			c.close(conn, wsCloseTokenExpired, "token expired")
+			return
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case reply := <-replies:
+			if err := c.write(conn, reply); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				c.close(conn, websocket.CloseTryAgainLater, "too slow, reconnect")
+				return
+			}
+			if !c.wants(event) {
+				continue
+			}
+			if err := c.write(conn, wsServerMessage{Type: event.Type, EventId: event.Id, Data: event.Data}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wants reports whether the client should get event: chirp changes of
+// subscribed authors, likes of the client's own chirps and the client's
+// notifications.
+func (c *wsClient) wants(event pubsub.Event) bool {
+	switch data := event.Data.(type) {
+	case database.Chirp:
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		_, ok := c.authors[data.UserId]
+		return ok
+	case database.Like:
+		return data.AuthorId == c.user.Id
+	case database.Notification:
+		return data.UserId == c.user.Id
+	}
+	return false
+}
+
+func (c *wsClient) write(conn *websocket.Conn, msg wsServerMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(msg)
+}
+
+func (c *wsClient) close(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+}